@@ -0,0 +1,41 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package config
+
+import (
+	"os"
+
+	"github.com/lexurco/gobuffet/serve"
+	"github.com/lexurco/gobuffet/util"
+)
+
+func usage() {
+	util.Die("usage: " + os.Args[0] + " config print [serve options ...]")
+}
+
+func Config(args []string) {
+	if len(args) < 2 {
+		usage()
+	}
+
+	switch args[1] {
+	case "print":
+		if err := serve.PrintConfig(os.Stdout, args[2:]); err != nil {
+			util.Die(err)
+		}
+	default:
+		usage()
+	}
+}
@@ -17,7 +17,9 @@ package main
 import (
 	"os"
 
+	"github.com/lexurco/gobuffet/config"
 	"github.com/lexurco/gobuffet/item"
+	"github.com/lexurco/gobuffet/order"
 	"github.com/lexurco/gobuffet/pw"
 	"github.com/lexurco/gobuffet/serve"
 	"github.com/lexurco/gobuffet/tg"
@@ -30,8 +32,12 @@ func main() {
 	}
 
 	switch os.Args[1] {
+	case "config":
+		config.Config(os.Args[1:])
 	case "item":
 		item.Item(os.Args[1:])
+	case "order":
+		order.Order(os.Args[1:])
 	case "pw":
 		pw.Pw(os.Args[1:])
 	case "serve":
@@ -40,6 +46,6 @@ func main() {
 		tg.Tg(os.Args[1:])
 	default:
 		util.Die("unknown subcommand: " + os.Args[1] + "\n" +
-			"available subcommands: item, pw, serve, tg")
+			"available subcommands: config, item, order, pw, serve, tg")
 	}
 }
@@ -20,7 +20,85 @@ CREATE TABLE items (
 	name	VARCHAR(50) NOT NULL UNIQUE,	-- short name
 	descr	TEXT,				-- longer description
 	price	INT,				-- price in smallest subunits
-	img	VARCHAR(128)			-- path to image file
+	img	VARCHAR(128),			-- path to image file
+	vat_rate	INT NOT NULL DEFAULT 0,		-- in 0.01% units, included in price
+	updated_at	TIMESTAMPTZ NOT NULL DEFAULT now(),
+	sold_out_until	TIMESTAMPTZ,			-- unavailable until then
+	max_qty	INT CHECK (max_qty > 0),	-- per order, if not the default
+	slug	VARCHAR(64) UNIQUE		-- in URLs, made of the name
+);
+
+DROP TABLE IF EXISTS variants CASCADE;
+CREATE TABLE variants (
+	item_id	INT NOT NULL REFERENCES items (id)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	label	VARCHAR(50) NOT NULL,		-- e.g. size
+	price	INT NOT NULL,			-- price in smallest subunits
+	ord	INT NOT NULL DEFAULT 0,		-- position in the list
+	PRIMARY KEY (item_id, label)
+);
+
+DROP TABLE IF EXISTS modifiers CASCADE;
+CREATE TABLE modifiers (
+	item_id	INT NOT NULL REFERENCES items (id)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	label	VARCHAR(50) NOT NULL,		-- e.g. extra cheese
+	price	INT NOT NULL DEFAULT 0,		-- price change in smallest subunits
+	multi	BOOLEAN NOT NULL DEFAULT TRUE,	-- false if mutually exclusive
+	ord	INT NOT NULL DEFAULT 0,		-- position in the list
+	PRIMARY KEY (item_id, label)
+);
+
+DROP TABLE IF EXISTS item_translations CASCADE;
+CREATE TABLE item_translations (
+	item_id	INT NOT NULL REFERENCES items (id)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	lang	VARCHAR(16) NOT NULL,		-- e.g. ka or en-US
+	name	VARCHAR(50),
+	descr	TEXT,
+	PRIMARY KEY (item_id, lang)
+);
+
+DROP TABLE IF EXISTS orders CASCADE;
+CREATE TABLE orders (
+	id		INT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+	created_at	TIMESTAMPTZ NOT NULL DEFAULT now(),
+	name		TEXT NOT NULL,			-- customer name
+	contact		TEXT NOT NULL,
+	address		TEXT NOT NULL,
+	comments	TEXT,
+	delivery	INT NOT NULL DEFAULT 0,		-- delivery fee
+	tip		INT NOT NULL DEFAULT 0,
+	vat		INT NOT NULL DEFAULT 0,		-- included in total
+	total		INT NOT NULL,			-- including delivery and tip
+	canceled_at	TIMESTAMPTZ,			-- if the customer canceled
+	status		VARCHAR(16)			-- accepted or rejected by the shop
+		CHECK (status IN ('accepted', 'rejected'))
+);
+
+DROP TABLE IF EXISTS order_items CASCADE;
+CREATE TABLE order_items (
+	order_id	INT NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+	item_id		INT REFERENCES items (id)
+		ON DELETE SET NULL ON UPDATE CASCADE,
+	name		VARCHAR(50) NOT NULL,		-- item name when ordered
+	variant		VARCHAR(50),
+	modifiers	TEXT[],
+	price		INT NOT NULL,			-- unit price when ordered
+	num		INT NOT NULL,			-- quantity
+	vat		INT NOT NULL DEFAULT 0		-- of the line, included in price
+);
+
+DROP TABLE IF EXISTS branding CASCADE;
+CREATE TABLE branding (
+	kind	VARCHAR(16) PRIMARY KEY,	-- logo or favicon
+	img	VARCHAR(128) NOT NULL		-- path to image file
+);
+
+DROP TABLE IF EXISTS settings CASCADE;
+CREATE TABLE settings (
+	key	VARCHAR(32) PRIMARY KEY,	-- e.g. title
+	value	TEXT NOT NULL			-- overriding the flag of serve
 );
 
 DROP TABLE IF EXISTS passwd CASCADE;
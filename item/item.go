@@ -15,10 +15,13 @@
 package item
 
 import (
+	"bufio"
 	"flag"
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path"
 
 	iutil "github.com/lexurco/gobuffet/item/util"
 	"github.com/lexurco/gobuffet/util"
@@ -28,32 +31,101 @@ var (
 	flags  = flag.NewFlagSet(os.Args[0] + " item", flag.ExitOnError)
 	dbFlag = flags.String("db", "",
 		"database connection string or URI (environment is used if empty)")
+	imgDirFlag = flags.String("imgdir", "img", "image directory")
+	configFlag = flags.String("config", "",
+		"JSON file of serve flags, of which those of item are used")
 
 	addFlags = flag.NewFlagSet(os.Args[0] + " item add", flag.ExitOnError)
-	descrAddFlag, imgAddFlag string
+	descrAddFlag, imgAddFlag, imgurlAddFlag, slugAddFlag string
 	idAddFlag int
-	priceAddFlag iutil.Price = 0
+	priceAddFlag iutil.OptPrice
+	vatAddFlag iutil.Rate
+	maxqtyAddFlag int
+	variantsAddFlag iutil.Variants
+	modifiersAddFlag iutil.Modifiers
 
 	modFlags = flag.NewFlagSet(os.Args[0] + " item mod", flag.ExitOnError)
-	nameModFlag, descrModFlag, imgModFlag string
-	nodescrModFlag, noimgModFlag bool
+	nameModFlag, descrModFlag, imgModFlag, slugModFlag string
+	nodescrModFlag, noimgModFlag, reslugModFlag bool
 	idModFlag int
-	priceModFlag iutil.Price = -1
+	priceModFlag iutil.OptPrice
+	vatModFlag iutil.OptRate
+	maxqtyModFlag int
+	variantsModFlag iutil.Variants
+	novariantsModFlag bool
+	modifiersModFlag iutil.Modifiers
+	nomodifiersModFlag bool
+
+	showFlags = flag.NewFlagSet(os.Args[0] + " item show", flag.ExitOnError)
+	sortShowFlag iutil.Order
+	formatShowFlag string
+	minpriceShowFlag iutil.OptPrice
+	maxpriceShowFlag iutil.OptPrice
+
+	repriceFlags = flag.NewFlagSet(os.Args[0] + " item reprice", flag.ExitOnError)
+	mulRepriceFlag float64
+	addRepriceFlag string
+	dryrunRepriceFlag bool
+
+	searchFlags = flag.NewFlagSet(os.Args[0] + " item search", flag.ExitOnError)
+	sortSearchFlag = iutil.ByRelevance
+
+	importFlags = flag.NewFlagSet(os.Args[0] + " item import", flag.ExitOnError)
+	dryrunImportFlag bool
 )
 
 func init() {
+	iutil.CurFlags(flags)
+
 	addFlags.StringVar(&descrAddFlag, "descr", "", "item description")
 	addFlags.StringVar(&imgAddFlag, "img", "", "item image")
+	addFlags.StringVar(&imgurlAddFlag, "imgurl", "", "URL of item image")
 	addFlags.IntVar(&idAddFlag, "id", -1, "item id (automatic if <0)")
-	addFlags.Var(&priceAddFlag, "price", "item price")
+	addFlags.Var(&priceAddFlag, "price", "item price (required, may be 0)")
+	addFlags.Var(&vatAddFlag, "vat", "VAT rate in percent, included in the price")
+	addFlags.IntVar(&maxqtyAddFlag, "maxqty", 0,
+		"most of the item in an order (serve's -itemqty if 0)")
+	addFlags.StringVar(&slugAddFlag, "slug", "", "name in URLs (made of the name if empty)")
+	addFlags.Var(&variantsAddFlag, "variant", "item variant as label=price (repeatable)")
+	addFlags.Var(&modifiersAddFlag, "modifier",
+		"item modifier as label=price [single] (repeatable)")
 
 	modFlags.StringVar(&nameModFlag, "name", "", "new name")
 	modFlags.StringVar(&descrModFlag, "descr", "", "new description")
 	modFlags.StringVar(&imgModFlag, "img", "", "new image")
 	modFlags.BoolVar(&nodescrModFlag, "nodescr", false, "remove any description")
 	modFlags.BoolVar(&noimgModFlag, "noimg", false, "remove any image")
+	modFlags.StringVar(&slugModFlag, "slug", "", "new name in URLs")
+	modFlags.BoolVar(&reslugModFlag, "reslug", false, "make the name in URLs anew of the name")
 	modFlags.IntVar(&idModFlag, "id", -1, "new id (ignored if <0)")
 	modFlags.Var(&priceModFlag, "price", "new price")
+	modFlags.Var(&vatModFlag, "vat", "new VAT rate in percent")
+	modFlags.IntVar(&maxqtyModFlag, "maxqty", -1,
+		"new most of the item in an order (0 for serve's -itemqty, ignored if <0)")
+	modFlags.Var(&variantsModFlag, "variant",
+		"new variant as label=price (repeatable, replaces all variants)")
+	modFlags.BoolVar(&novariantsModFlag, "novariants", false, "remove all variants")
+	modFlags.Var(&modifiersModFlag, "modifier",
+		"new modifier as label=price [single] (repeatable, replaces all modifiers)")
+	modFlags.BoolVar(&nomodifiersModFlag, "nomodifiers", false, "remove all modifiers")
+
+	showFlags.Var(&sortShowFlag, "sort", "order of the items: id, name or price")
+	showFlags.Var(&minpriceShowFlag, "minprice", "only show items costing at least this")
+	showFlags.Var(&maxpriceShowFlag, "maxprice", "only show items costing at most this")
+	showFlags.StringVar(&formatShowFlag, "format", "table",
+		"output format: table, or jsonl for an item JSON object per line")
+
+	repriceFlags.Float64Var(&mulRepriceFlag, "mul", 1, "multiply prices by this")
+	repriceFlags.StringVar(&addRepriceFlag, "add", "0",
+		"add this (possibly negative) amount to prices, after -mul")
+	repriceFlags.BoolVar(&dryrunRepriceFlag, "dry-run", false,
+		"only show what the new prices would be")
+
+	searchFlags.Var(&sortSearchFlag, "sort",
+		"order of the items: id, name, price or relevance")
+
+	importFlags.BoolVar(&dryrunImportFlag, "dry-run", false,
+		"only check the file, adding nothing")
 }
 
 func cmdAdd(args []string) {
@@ -89,9 +161,29 @@ func cmdAdd(args []string) {
 			util.Die(err)
 		}
 		defer imgFile.Close()
+	} else if imgurlAddFlag != "" {
+		name, r, err := iutil.FetchImg(context.Background(), imgurlAddFlag)
+		if err != nil {
+			util.Die(err)
+		}
+		it.Img.Name = &name
+		it.Img.Reader = r
 	}
 
-	it.Price = (*int)(&priceAddFlag)
+	if !priceAddFlag.Given {
+		util.Die("no price specified")
+	}
+	it.Price = &priceAddFlag.Price
+	it.VAT = (*int)(&vatAddFlag)
+	if maxqtyAddFlag < 0 {
+		util.Die("negative -maxqty")
+	}
+	it.MaxQty = &maxqtyAddFlag
+	if slugAddFlag != "" {
+		it.Slug = &slugAddFlag
+	}
+	it.Variants = variantsAddFlag
+	it.Modifiers = modifiersAddFlag
 
 	db, err := util.DBConnect(*dbFlag)
 	if err != nil {
@@ -99,9 +191,11 @@ func cmdAdd(args []string) {
 	}
 	defer db.Close(context.Background())
 
-	if err = iutil.Add(db, &it); err != nil {
+	id, err := iutil.Add(context.Background(), db, &it)
+	if err != nil {
 		util.Die(err)
 	}
+	fmt.Println(id)
 }
 
 func cmdDel(args []string) {
@@ -126,7 +220,7 @@ func cmdDel(args []string) {
 	}
 	defer db.Close(context.Background())
 
-	if err := iutil.Del(db, ids, names); err != nil {
+	if _, err := iutil.Del(db, ids, names); err != nil {
 		util.Die(err)
 	}
 }
@@ -157,8 +251,33 @@ func cmdMod(args []string) {
 		it.Descr = &descrModFlag
 	}
 
-	if priceModFlag >= 0 {
-		it.Price = (*int)(&priceModFlag)
+	if priceModFlag.Given {
+		it.Price = &priceModFlag.Price
+	}
+	if vatModFlag.Given {
+		it.VAT = &vatModFlag.Rate
+	}
+	if maxqtyModFlag >= 0 {
+		it.MaxQty = &maxqtyModFlag
+	}
+
+	if reslugModFlag {
+		slugModFlag = ""
+		it.Slug = &slugModFlag
+	} else if slugModFlag != "" {
+		it.Slug = &slugModFlag
+	}
+
+	if novariantsModFlag {
+		it.Variants = []iutil.Variant{}
+	} else if len(variantsModFlag) > 0 {
+		it.Variants = variantsModFlag
+	}
+
+	if nomodifiersModFlag {
+		it.Modifiers = []iutil.Modifier{}
+	} else if len(modifiersModFlag) > 0 {
+		it.Modifiers = modifiersModFlag
 	}
 
 	if noimgModFlag {
@@ -184,14 +303,119 @@ func cmdMod(args []string) {
 	}
 	defer db.Close(context.Background())
 
-	iutil.Mod(db, id, name, &it)
+	if err = iutil.Mod(context.Background(), db, id, name, &it); err != nil {
+		util.Die(err)
+	}
+}
+
+// cmdFillSlugs gives the items added before there were slugs slugs.
+func cmdFillSlugs(args []string) {
+	if len(args) != 1 {
+		util.Die("usage: " + os.Args[0] + " item fillslugs")
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	n, err := iutil.FillSlugs(db)
+	if err != nil {
+		util.Die(err)
+	}
+	fmt.Println(n)
+}
+
+// cmdRename renames an item, refusing to take the name of another item.
+func cmdRename(args []string) {
+	if len(args) != 3 || args[2] == "" {
+		util.Die("usage: " + os.Args[0] + " item rename item newname")
+	}
+	id, name, err := iutil.ParseItem(args[1])
+	if err != nil {
+		util.Die(err)
+	}
+	newName := args[2]
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	var ids []int
+	var names []string
+	if id >= 0 {
+		ids = []int{id}
+	} else {
+		names = []string{name}
+	}
+	items, err := iutil.Get(db, ids, names, iutil.ByID)
+	if err != nil {
+		util.Die(err)
+	}
+	if len(items) == 0 {
+		util.Die("no such item: " + args[1])
+	}
+
+	items, err = iutil.Get(db, nil, []string{newName}, iutil.ByID)
+	if err != nil {
+		util.Die(err)
+	}
+	if len(items) > 0 {
+		util.Die(fmt.Sprintf("item %v already has the name %v", *items[0].ID, newName))
+	}
+
+	if err = iutil.Mod(context.Background(), db, id, name,
+		&iutil.Item{Name: &newName}); err != nil {
+
+		util.Die(err)
+	}
+}
+
+// cmdRecover finishes or removes the images of interrupted uploads.
+func cmdRecover(args []string) {
+	var dir string
+	switch len(args) {
+	case 1:
+	case 2:
+		dir = args[1]
+	default:
+		util.Die("usage: " + os.Args[0] + " item recover [dir]")
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	if err = util.LockImgs(false); err != nil {
+		util.Die(err, "(is serve running?)")
+	}
+
+	finished, removed, err := iutil.RecoverImgs(db, dir)
+	for _, img := range finished {
+		fmt.Println("finished", img)
+	}
+	for _, img := range removed {
+		fmt.Println("removed", img)
+	}
+	if err != nil {
+		util.Die(err)
+	}
 }
 
 func cmdShow(args []string) {
 	var names []string
 	var ids []int
 
-	for _, a := range args[1:] {
+	showFlags.Parse(args[1:])
+	if formatShowFlag != "table" && formatShowFlag != "jsonl" {
+		util.Die("invalid format " + formatShowFlag + " (must be table or jsonl)")
+	}
+	for _, a := range showFlags.Args() {
 		id, name, err := iutil.ParseItem(a)
 		if err != nil {
 			util.Die(err)
@@ -209,27 +433,175 @@ func cmdShow(args []string) {
 	}
 	defer db.Close(context.Background())
 
-	items, err := iutil.Get(db, ids, names, iutil.ByID)
+	pr := iutil.AnyPrice
+	if minpriceShowFlag.Given {
+		pr.Min = minpriceShowFlag.Price
+	}
+	if maxpriceShowFlag.Given {
+		pr.Max = maxpriceShowFlag.Price
+	}
+	if formatShowFlag == "jsonl" {
+		w := bufio.NewWriter(os.Stdout)
+		enc := json.NewEncoder(w)
+		err = iutil.EachIn(db, ids, names, pr, sortShowFlag, func(it *iutil.Item) error {
+			return enc.Encode(it)
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			util.Die(err)
+		}
+		return
+	}
+
+	items, err := iutil.GetIn(db, ids, names, pr, sortShowFlag)
 	if err != nil {
 		util.Die(err)
 	}
+	printItems(items)
+}
+
+// printItems prints a table of items.
+func printItems(items []iutil.Item) {
 	fmt.Printf("%5v %15v %8v %40v %v\n", "ID", "NAME", "PRICE", "IMAGE", "DESCRIPTION")
 	for i := range items {
-		var descr, img string
+		descr := iutil.Or(items[i].Descr, "-")
+		img := iutil.Or(items[i].Img.Name, "-")
+		price := "-"
+		if items[i].Price != nil {
+			price = iutil.Cur.String(*items[i].Price)
+		}
 
-		if items[i].Descr != nil {
-			descr = *items[i].Descr
-		} else {
-			descr = "-"
+		fmt.Printf("%5v %15v %8v %40v %v\n", *items[i].ID, *items[i].Name,
+			price, img, descr)
+		for _, v := range items[i].Variants {
+			fmt.Printf("%5v %15v %8v\n", "", v.Label, iutil.Cur.String(v.Price))
+		}
+		for _, m := range items[i].Modifiers {
+			single := ""
+			if !m.Multi {
+				single = " (single)"
+			}
+			fmt.Printf("%5v %15v %8v%v\n", "", "+ "+m.Label,
+				iutil.Cur.String(m.Price), single)
+		}
+	}
+}
+
+func cmdSearch(args []string) {
+	searchFlags.Parse(args[1:])
+	if searchFlags.NArg() != 1 {
+		util.Die("usage: " + os.Args[0] + " item search [flags ...] query")
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	items, err := iutil.Search(db, searchFlags.Arg(0), sortSearchFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	printItems(items)
+}
+
+func cmdReprice(args []string) {
+	var names []string
+	var ids []int
+	var op iutil.RepriceOp
+	var err error
+
+	repriceFlags.Parse(args[1:])
+	args = repriceFlags.Args()
+
+	if mulRepriceFlag < 0 {
+		util.Die("-mul must not be negative")
+	}
+	op.Mul = mulRepriceFlag
+	if op.Add, err = iutil.Cur.ParseDelta(addRepriceFlag); err != nil {
+		util.Die(err)
+	}
+
+	for _, a := range args {
+		id, name, err := iutil.ParseItem(a)
+		if err != nil {
+			util.Die(err)
 		}
-		if items[i].Img.Name != nil {
-			img = *items[i].Img.Name
+		if id >= 0 {
+			ids = append(ids, id)
 		} else {
-			img = "-"
+			names = append(names, name)
 		}
+	}
 
-		fmt.Printf("%5v %15v %5v.%02v %40v %v\n", *items[i].ID, *items[i].Name,
-			*items[i].Price/100, *items[i].Price%100, img, descr)
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	changes, err := iutil.Reprice(db, ids, names, op, dryrunRepriceFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	fmt.Printf("%5v %15v %8v %8v\n", "ID", "NAME", "OLD", "NEW")
+	for _, c := range changes {
+		fmt.Printf("%5v %15v %8v %8v\n", c.ID, c.Name, iutil.Cur.String(c.Old),
+			iutil.Cur.String(c.New))
+	}
+}
+
+// cmdImport adds the items of a CSV file, all of them or, if any is
+// wrong, none.
+func cmdImport(args []string) {
+	importFlags.Parse(args[1:])
+	if importFlags.NArg() != 1 {
+		util.Die("usage: " + os.Args[0] + " item import [flags ...] file")
+	}
+	file := importFlags.Arg(0)
+
+	f, err := os.Open(file)
+	if err != nil {
+		util.Die(err)
+	}
+	items, errs := iutil.ReadCSV(f)
+	f.Close()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, file+": "+err.Error())
+	}
+	if len(errs) > 0 {
+		util.Die(fmt.Sprintf("%v: %v error(s), nothing added", file, len(errs)))
+	}
+	if dryrunImportFlag {
+		fmt.Printf("%v: %v item(s) to add\n", file, len(items))
+		return
+	}
+
+	for i := range items {
+		if it := &items[i]; it.Img.Name != nil {
+			img, err := os.Open(*it.Img.Name)
+			if err != nil {
+				util.Die(err)
+			}
+			defer img.Close()
+			it.Img.Reader = img
+		}
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	if err = iutil.AddBatch(context.Background(), db, items); err != nil {
+		util.Die(err)
+	}
+	for _, it := range items {
+		fmt.Println(*it.ID)
 	}
 }
 
@@ -238,18 +610,40 @@ func Item(args []string) {
 	if args = flags.Args(); len(args) < 1 {
 		util.Die("usage: "+os.Args[0]+" item [flags ...] command")
 	}
+	if err := util.LoadEnv(flags); err != nil {
+		util.Die(err)
+	}
+	if *configFlag != "" {
+		if err := util.LoadSharedConfig(flags, *configFlag); err != nil {
+			util.Die(*configFlag + ": " + err.Error())
+		}
+	}
+	util.ImgDir = path.Clean(*imgDirFlag)
 
 	switch args[0] {
 	case "add":
 		cmdAdd(args)
 	case "del":
 		cmdDel(args)
+	case "fillslugs":
+		cmdFillSlugs(args)
+	case "import":
+		cmdImport(args)
 	case "mod":
 		cmdMod(args)
+	case "recover":
+		cmdRecover(args)
+	case "rename":
+		cmdRename(args)
+	case "reprice":
+		cmdReprice(args)
+	case "search":
+		cmdSearch(args)
 	case "show":
 		cmdShow(args)
 	default:
 		util.Die("unknown subcommand: " + args[0] + "\n" +
-			"available subcommands: add, del, mod, show")
+			"available subcommands: add, del, fillslugs, import, mod, recover, rename, " +
+			"reprice, search, show")
 	}
 }
@@ -15,18 +15,42 @@
 package util
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/lexurco/gobuffet/util"
 )
@@ -36,24 +60,244 @@ type Item struct {
 	Name  *string
 	Descr *string
 	Price *int
-	Img   struct {
+	VAT   *int // rate in hundredths of a percent, included in Price
+
+	// MaxQty is the most of the item one may order, if not the default.
+	// Mod unsets it if 0.
+	MaxQty *int
+
+	// Slug names the item in URLs.  Add makes it of the name if it is
+	// unset, and keeps it unique, as Mod does.  It stays as it is when
+	// the item is renamed, unless Mod is given "", which makes it anew
+	// of the name.
+	Slug *string
+
+	Img struct {
 		Name   *string
 		Reader io.Reader
+		Dir    string // subdirectory of the image directory to copy to
+		Staged bool   // Name is of an image staged by StageImg
+	}
+
+	// Updated is when the item last changed.  It is set by the
+	// database and ignored by Add and Mod.
+	Updated time.Time
+
+	// SoldOutUntil is when the item is available again if it is sold
+	// out, and the zero time otherwise.  It is set by SetSoldOut and
+	// ignored by Add and Mod.
+	SoldOutUntil time.Time
+
+	// Variants of the item, e.g. sizes, each with its own price.  For
+	// Mod, nil leaves the variants alone and anything else replaces them.
+	Variants []Variant
+
+	// Modifiers (add-ons) the customer may choose, with the same
+	// semantics for Mod as Variants.
+	Modifiers []Modifier
+
+	// Translations of the name and description by language.  They are
+	// set by SetTranslation and ignored by Add and Mod.
+	Translations map[string]Translation
+}
+
+// Or returns *p, or def if p is nil.
+func Or[T any](p *T, def T) (v T) {
+	if p == nil {
+		return def
 	}
+	return *p
 }
 
-type Price int
+// String describes it on one line, for debugging.  Unset fields are -.
+func (it *Item) String() (s string) {
+	str := func(p *string) string {
+		if p == nil {
+			return "-"
+		}
+		return strconv.Quote(*p)
+	}
+	price := "-"
+	if it.Price != nil {
+		price = Cur.Format(*it.Price)
+	}
+	id := "-"
+	if it.ID != nil {
+		id = strconv.Itoa(*it.ID)
+	}
+	return fmt.Sprintf("item %v %v %v img %v descr %v, %v variants, %v modifiers",
+		id, str(it.Name), price, str(it.Img.Name), str(it.Descr),
+		len(it.Variants), len(it.Modifiers))
+}
+
+// jsonPrice is a price in JSON, in minor units and formatted with Cur.
+type jsonPrice struct {
+	Num int    `json:"num"`
+	Str string `json:"str"`
+}
 
-var priceRE = regexp.MustCompile(`^([1-9][0-9]*|0)(\.[0-9][0-9]?)?$`)
+func newJSONPrice(n int) (p *jsonPrice) {
+	return &jsonPrice{Num: n, Str: Cur.Format(n)}
+}
 
-func (p *Price) Set(s string) (err error) {
-	match := priceRE.FindStringSubmatch(s)
-	if match == nil {
-		return errors.New("invalid price")
+// MarshalJSON encodes it with prices as in jsonPrice and unset fields as
+// null.  The image reader is left out.
+func (it *Item) MarshalJSON() (b []byte, err error) {
+	type variant struct {
+		Label string     `json:"label"`
+		Price *jsonPrice `json:"price"`
+	}
+	type modifier struct {
+		Label string     `json:"label"`
+		Price *jsonPrice `json:"price"`
+		Multi bool       `json:"multi"`
+	}
+	v := struct {
+		ID           *int                   `json:"id"`
+		Name         *string                `json:"name"`
+		Descr        *string                `json:"descr"`
+		Price        *jsonPrice             `json:"price"`
+		VAT          *int                   `json:"vat_rate"`
+		MaxQty       *int                   `json:"max_qty"`
+		Slug         *string                `json:"slug"`
+		Img          *string                `json:"img"`
+		Updated      *time.Time             `json:"updated"`
+		SoldOutUntil *time.Time             `json:"sold_out_until"`
+		Variants     []variant              `json:"variants"`
+		Modifiers    []modifier             `json:"modifiers"`
+		Translations map[string]Translation `json:"translations"`
+	}{
+		ID:           it.ID,
+		Name:         it.Name,
+		Descr:        it.Descr,
+		VAT:          it.VAT,
+		MaxQty:       it.MaxQty,
+		Slug:         it.Slug,
+		Img:          it.Img.Name,
+		Variants:     []variant{},
+		Modifiers:    []modifier{},
+		Translations: it.Translations,
+	}
+	if it.Price != nil {
+		v.Price = newJSONPrice(*it.Price)
+	}
+	if !it.Updated.IsZero() {
+		v.Updated = &it.Updated
+	}
+	if !it.SoldOutUntil.IsZero() {
+		v.SoldOutUntil = &it.SoldOutUntil
+	}
+	for _, x := range it.Variants {
+		v.Variants = append(v.Variants, variant{x.Label, newJSONPrice(x.Price)})
+	}
+	for _, x := range it.Modifiers {
+		v.Modifiers = append(v.Modifiers, modifier{x.Label, newJSONPrice(x.Price), x.Multi})
+	}
+	return json.Marshal(v)
+}
+
+// Translation is the name and description of an item in another language.
+// Empty fields are untranslated.
+type Translation struct {
+	Name  string `json:"name,omitempty"`
+	Descr string `json:"descr,omitempty"`
+}
+
+type Variant struct {
+	Label string
+	Price int
+}
+
+// Modifier changes the price of an item by Price, which may be negative.
+// At most one of the single-select (!Multi) modifiers of an item may be
+// chosen.
+type Modifier struct {
+	Label string
+	Price int
+	Multi bool
+}
+
+// Currency describes how amounts, kept as integers in minor units, are
+// parsed and shown.
+type Currency struct {
+	Code   string // ISO 4217 code, e.g. GEL
+	Symbol string // Code is used if empty
+	Before bool   // whether the symbol goes before the amount
+	Minor  int    // number of digits of the minor unit
+}
+
+// Cur is the currency used by Price.
+var Cur = Currency{Code: "GEL", Minor: 2}
+
+// CurFlags defines the flags setting Cur in fs, for the subcommands that
+// parse or show amounts to take the shop's currency alike.
+func CurFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Cur.Code, "currency", Cur.Code, "currency code")
+	fs.StringVar(&Cur.Symbol, "symbol", Cur.Symbol,
+		"currency symbol (currency code if empty)")
+	fs.BoolVar(&Cur.Before, "symbolbefore", Cur.Before,
+		"put the currency symbol before amounts")
+	fs.IntVar(&Cur.Minor, "minor", Cur.Minor,
+		"number of digits of the currency minor unit")
+}
+
+var amountRE = regexp.MustCompile(`^([1-9][0-9]*|0)(\.([0-9]+))?$`)
+
+// Parse parses a non-negative amount in major units, e.g. 12.5, into minor
+// units.
+func (c *Currency) Parse(s string) (n int, err error) {
+	match := amountRE.FindStringSubmatch(s)
+	if match == nil || len(match[3]) > c.Minor {
+		return 0, errors.New("invalid price")
+	}
+	return strconv.Atoi(match[1] + match[3] + strings.Repeat("0", c.Minor-len(match[3])))
+}
+
+// String returns the amount n of minor units in major units, without the
+// symbol.
+func (c *Currency) String(n int) (s string) {
+	neg := n < 0
+	if neg {
+		n *= -1
+	}
+
+	s = strconv.Itoa(n)
+	if c.Minor > 0 {
+		if len(s) <= c.Minor {
+			s = strings.Repeat("0", c.Minor-len(s)+1) + s
+		}
+		s = s[:len(s)-c.Minor] + "." + s[len(s)-c.Minor:]
+	}
+
+	if neg {
+		return "-" + s
+	}
+	return s
+}
+
+// Convert converts the amount n of c to the currency to, of which one unit
+// of c is worth rate.  The result is rounded to the minor unit of to.
+func (c *Currency) Convert(n int, to *Currency, rate float64) (m int) {
+	return int(math.Round(float64(n) * rate * math.Pow10(to.Minor-c.Minor)))
+}
+
+// Format is String with the currency symbol.
+func (c *Currency) Format(n int) (s string) {
+	sym := c.Symbol
+	if sym == "" {
+		sym = c.Code
 	}
-	subprice := strings.Replace(match[2], ".", "", 1)
-	subprice += strings.Repeat("0", 2-len(subprice))
-	n, err := strconv.Atoi(match[1] + subprice)
+	if c.Before {
+		return sym + c.String(n)
+	}
+	return c.String(n) + " " + sym
+}
+
+// Price is an amount in minor units of Cur.
+type Price int
+
+func (p *Price) Set(s string) (err error) {
+	n, err := Cur.Parse(s)
 	if err != nil {
 		return err
 	}
@@ -62,153 +306,1520 @@ func (p *Price) Set(s string) (err error) {
 }
 
 func (p *Price) String() (s string) {
-	n := int(*p)
-	if n < 0 {
-		n *= -1
+	return Cur.String(int(*p))
+}
+
+// OptPrice is a Price flag that tells being left unset from being 0.
+type OptPrice struct {
+	Price int
+	Given bool
+}
+
+func (p *OptPrice) Set(s string) (err error) {
+	if err = (*Price)(&p.Price).Set(s); err == nil {
+		p.Given = true
 	}
+	return err
+}
 
-	s = strconv.Itoa(n)
-	switch {
-	case n < 10:
-		s = "0.0" + s
-	case n < 100:
-		s = "0." + s
-	default:
-		s = s[:len(s)-2] + "." + s[len(s)-2:]
+// String returns "" if p is unset, so that no default is shown for it.
+func (p *OptPrice) String() (s string) {
+	if !p.Given {
+		return ""
 	}
+	return (*Price)(&p.Price).String()
+}
 
-	switch {
-	case *p < 0:
-		return "-" + s
-	default:
-		return s
+// rateCur formats and parses rates as amounts with two decimals.
+var rateCur = Currency{Minor: 2}
+
+// Rate is a tax rate in hundredths of a percent.
+type Rate int
+
+// ParseRate parses a rate given in percent, e.g. 18 or 7.5%.
+func ParseRate(s string) (r int, err error) {
+	r, err = rateCur.Parse(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil || r > 100_00 {
+		return 0, errors.New("invalid rate")
+	}
+	return r, nil
+}
+
+// FormatRate returns r in percent, without the percent sign.
+func FormatRate(r int) (s string) {
+	return rateCur.String(r)
+}
+
+func (r *Rate) Set(s string) (err error) {
+	n, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = Rate(n)
+	return nil
+}
+
+func (r *Rate) String() (s string) {
+	return FormatRate(int(*r))
+}
+
+// OptRate is a Rate flag that tells being left unset from being 0.
+type OptRate struct {
+	Rate  int
+	Given bool
+}
+
+func (r *OptRate) Set(s string) (err error) {
+	if err = (*Rate)(&r.Rate).Set(s); err == nil {
+		r.Given = true
+	}
+	return err
+}
+
+// String returns "" if r is unset, so that no default is shown for it.
+func (r *OptRate) String() (s string) {
+	if !r.Given {
+		return ""
+	}
+	return (*Rate)(&r.Rate).String()
+}
+
+// VATOf returns the VAT included in gross at rate, rounded half up.
+func VATOf(gross, rate int) (vat int) {
+	return (gross*rate + (100_00+rate)/2) / (100_00 + rate)
+}
+
+// ParseVariant parses a variant given as label=price.
+func (c *Currency) ParseVariant(s string) (v Variant, err error) {
+	label, price, ok := strings.Cut(s, "=")
+	label = strings.TrimSpace(label)
+	if !ok || label == "" {
+		return v, errors.New("invalid variant " + s + " (must be label=price)")
+	}
+	if v.Price, err = c.Parse(strings.TrimSpace(price)); err != nil {
+		return v, err
+	}
+	v.Label = label
+	return v, nil
+}
+
+// ParseVariants parses a list of variants separated by commas or newlines.
+func (c *Currency) ParseVariants(s string) (vs []Variant, err error) {
+	vs = []Variant{}
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		v, err := c.ParseVariant(f)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// Variants is a flag.Value collecting variants given as label=price.
+type Variants []Variant
+
+func (vs *Variants) Set(s string) (err error) {
+	v, err := Cur.ParseVariant(s)
+	if err != nil {
+		return err
+	}
+	*vs = append(*vs, v)
+	return nil
+}
+
+func (vs *Variants) String() (s string) {
+	var l []string
+	for _, v := range *vs {
+		l = append(l, v.Label+"="+(*Price)(&v.Price).String())
+	}
+	return strings.Join(l, ",")
+}
+
+// ParseModifier parses a modifier given as label=price, optionally followed
+// by "single" for a single-select modifier.  The price may be negative.
+func (c *Currency) ParseModifier(s string) (m Modifier, err error) {
+	label, rest, ok := strings.Cut(s, "=")
+	label = strings.TrimSpace(label)
+	f := strings.Fields(rest)
+	if !ok || label == "" || len(f) == 0 || len(f) > 2 {
+		return m, errors.New("invalid modifier " + s + " (must be label=price [single])")
+	}
+
+	m.Label = label
+	m.Multi = true
+	if len(f) == 2 {
+		if f[1] != "single" {
+			return m, errors.New("invalid modifier " + s + " (must be label=price [single])")
+		}
+		m.Multi = false
+	}
+
+	if m.Price, err = c.ParseDelta(f[0]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// ParseDelta parses a price change, which may have a sign.
+func (c *Currency) ParseDelta(s string) (n int, err error) {
+	p, neg := strings.CutPrefix(s, "-")
+	if !neg {
+		p, _ = strings.CutPrefix(p, "+")
+	}
+	if n, err = c.Parse(p); err != nil {
+		return 0, err
+	}
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// ParseModifiers parses a list of modifiers separated by commas or newlines.
+func (c *Currency) ParseModifiers(s string) (ms []Modifier, err error) {
+	ms = []Modifier{}
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		m, err := c.ParseModifier(f)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// Modifiers is a flag.Value collecting modifiers as parsed by
+// Cur.ParseModifier.
+type Modifiers []Modifier
+
+func (ms *Modifiers) Set(s string) (err error) {
+	m, err := Cur.ParseModifier(s)
+	if err != nil {
+		return err
+	}
+	*ms = append(*ms, m)
+	return nil
+}
+
+func (ms *Modifiers) String() (s string) {
+	var l []string
+	for _, m := range *ms {
+		e := m.Label + "=" + (*Price)(&m.Price).String()
+		if !m.Multi {
+			e += " single"
+		}
+		l = append(l, e)
 	}
+	return strings.Join(l, ",")
 }
 
+// ParseItem parses an item selector, which is either id:N or name:S.
+// Without a prefix, a non-negative number is an ID and anything else is a
+// name, so a numeric name needs the name: prefix.
 func ParseItem(item string) (id int, name string, err error) {
-	if pre, suf, ok := strings.Cut(item, ":"); ok && pre == "name" {
+	switch pre, suf, _ := strings.Cut(item, ":"); pre {
+	case "name":
 		return -1, suf, nil
-	} else if id, err = strconv.Atoi(item); err == nil {
+	case "id":
+		if id, err = strconv.Atoi(suf); err != nil || id < 0 {
+			return -1, "", errors.New("invalid item id: " + suf)
+		}
+		return id, "", nil
+	}
+
+	if id, err = strconv.Atoi(item); err == nil && id >= 0 {
 		return id, "", nil
-	} else if err.(*strconv.NumError).Err != strconv.ErrSyntax {
+	} else if err != nil && err.(*strconv.NumError).Err != strconv.ErrSyntax {
 		return -1, "", err
-	} else {
-		return -1, item, nil
 	}
+	return -1, item, nil
 }
 
-func copyImg(name string, r io.Reader) (img string, err error) {
-	img = time.Now().Format("20060102_150405") + "_" + path.Base(name)
-	path := util.ImgPath(img)
+// imgTypes are the extensions and content types of the image formats that
+// http.DetectContentType knows, the preferred extension of a type first.
+// They are not taken from the system's MIME database, which may lack some,
+// e.g. webp.
+var imgTypes = []struct{ ext, ct string }{
+	{".jpg", "image/jpeg"},
+	{".jpeg", "image/jpeg"},
+	{".jpe", "image/jpeg"},
+	{".png", "image/png"},
+	{".gif", "image/gif"},
+	{".webp", "image/webp"},
+	{".bmp", "image/bmp"},
+	{".ico", "image/x-icon"},
+}
 
-	err = func() (err error) {
-		w, err := os.Create(path)
-		if err != nil {
-			return err
+// ImgType returns the content type of the image file name by its
+// extension, or "" if it is not of a known image format.
+func ImgType(name string) (ct string) {
+	ext := strings.ToLower(path.Ext(name))
+	for _, t := range imgTypes {
+		if t.ext == ext {
+			return t.ct
 		}
-		defer w.Close()
-		if _, err = io.Copy(w, r); err != nil {
-			os.Remove(path)
-			return err
+	}
+	return ""
+}
+
+// imgTypeAliases maps other content types given to the formats of imgTypes,
+// e.g. by browsers, to those of imgTypes.
+var imgTypeAliases = map[string]string{
+	"image/vnd.microsoft.icon": "image/x-icon",
+}
+
+// CanonImgType returns the content type of imgTypes that ct stands for,
+// which is ct itself unless it is an alias.
+func CanonImgType(ct string) (canon string) {
+	if canon, ok := imgTypeAliases[ct]; ok {
+		return canon
+	}
+	return ct
+}
+
+// ImgExt returns the extension for images of content type ct, or "" if it
+// is not a known image format.
+func ImgExt(ct string) (ext string) {
+	ct = CanonImgType(ct)
+	for _, t := range imgTypes {
+		if t.ct == ct {
+			return t.ext
+		}
+	}
+	return ""
+}
+
+// MaxImgSize is the maximum size of an image fetched by FetchImg.
+const MaxImgSize = 10 << 20 // 10 MiB
+
+// FetchTimeout is how long FetchImg may take.
+const FetchTimeout = 20 * time.Second
+
+// fetchClient is the HTTP client of FetchImg.  It connects to public
+// addresses only, so that the shop's users can't have the server fetch
+// from its own network.
+var fetchClient = &http.Client{
+	Timeout: FetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: FetchTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				return checkFetchAddr(address)
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: FetchTimeout,
+	},
+}
+
+// checkFetchAddr returns an error if FetchImg may not connect to address.
+// The tests replace it to fetch from loopback.
+var checkFetchAddr = func(address string) (err error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+
+		return errors.New("fetching image: non-public address " + host)
+	}
+	return nil
+}
+
+// FetchImg downloads an image from url, giving up when ctx is done or
+// after FetchTimeout.  The response must be an image, both by its
+// Content-Type and its contents, and no larger than MaxImgSize.  Only
+// public addresses are connected to.
+func FetchImg(ctx context.Context, url string) (name string, r io.ReadSeeker, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, errors.New("fetching image: " + resp.Status)
+	}
+	if resp.ContentLength > MaxImgSize {
+		return "", nil, errors.New("image is too large")
+	}
+	ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, errors.New("invalid content type of image")
+	}
+	if typ, _, ok := strings.Cut(ct, "/"); !ok || typ != "image" {
+		return "", nil, errors.New("not an image: " + ct)
+	}
+	ct = CanonImgType(ct)
+
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, MaxImgSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(buf) > MaxImgSize {
+		return "", nil, errors.New("image is too large")
+	}
+	if ct != http.DetectContentType(buf) && !(IsHEIC(buf) && HEICConverter != "") {
+		return "", nil, errors.New("invalid content type of image")
+	}
+
+	name = path.Base(resp.Request.URL.Path)
+	if name == "/" || name == "." {
+		name = "image"
+	}
+	if path.Ext(name) == "" {
+		name += ImgExt(ct)
+	}
+	return name, bytes.NewReader(buf), nil
+}
+
+// ImgLimits bounds the dimensions of an image.  Zero means no limit.
+type ImgLimits struct {
+	Width  int
+	Height int
+	Pixels int
+}
+
+// CheckImg decodes the image header from r and checks its dimensions
+// against lim.  Images in formats the decoder doesn't know are refused.
+// The reader is rewound afterwards.
+func CheckImg(r io.ReadSeeker, lim ImgLimits) (err error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if _, serr := r.Seek(0, io.SeekStart); serr != nil {
+		return serr
+	}
+	if err == image.ErrFormat {
+		return errors.New("unsupported image format")
+	} else if err != nil {
+		return errors.New("invalid image: " + err.Error())
+	}
+
+	if (lim.Width > 0 && cfg.Width > lim.Width) ||
+		(lim.Height > 0 && cfg.Height > lim.Height) ||
+		(lim.Pixels > 0 && cfg.Width*cfg.Height > lim.Pixels) {
+
+		return fmt.Errorf("image is too large (%vx%v)", cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// The other formats of imgTypes are only known to image by their headers,
+// for CheckImg: decoding them fails with image.ErrFormat.
+func init() {
+	noDecode := func(r io.Reader) (image.Image, error) {
+		return nil, image.ErrFormat
+	}
+	image.RegisterFormat("webp", "RIFF????WEBP", noDecode, webpConfig)
+	image.RegisterFormat("bmp", "BM", noDecode, bmpConfig)
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", noDecode, icoConfig)
+}
+
+// readHead reads the first n bytes of r.
+func readHead(r io.Reader, n int) (head []byte, err error) {
+	head = make([]byte, n)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return nil, errors.New("truncated header")
+	}
+	return head, nil
+}
+
+// webpConfig reads the dimensions of a lossy, lossless or extended WebP
+// image.
+func webpConfig(r io.Reader) (cfg image.Config, err error) {
+	head, err := readHead(r, 30)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.RGBAModel
+	le := binary.LittleEndian
+	switch string(head[12:16]) {
+	case "VP8 ":
+		if string(head[23:26]) != "\x9d\x01\x2a" {
+			return cfg, errors.New("bad VP8 start code")
+		}
+		cfg.Width = int(le.Uint16(head[26:]) & 0x3fff)
+		cfg.Height = int(le.Uint16(head[28:]) & 0x3fff)
+	case "VP8L":
+		if head[20] != 0x2f {
+			return cfg, errors.New("bad VP8L signature")
+		}
+		bits := le.Uint32(head[21:])
+		cfg.Width = int(bits&0x3fff) + 1
+		cfg.Height = int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		le24 := func(b []byte) int {
+			return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		}
+		cfg.Width = le24(head[24:]) + 1
+		cfg.Height = le24(head[27:]) + 1
+	default:
+		return cfg, errors.New("unknown WebP chunk")
+	}
+	return cfg, nil
+}
+
+// bmpConfig reads the dimensions of a BMP image.
+func bmpConfig(r io.Reader) (cfg image.Config, err error) {
+	head, err := readHead(r, 26)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ColorModel = color.RGBAModel
+	le := binary.LittleEndian
+	if le.Uint32(head[14:]) == 12 { // BITMAPCOREHEADER
+		cfg.Width = int(le.Uint16(head[18:]))
+		cfg.Height = int(le.Uint16(head[20:]))
+		return cfg, nil
+	}
+	cfg.Width = int(int32(le.Uint32(head[18:])))
+	cfg.Height = int(int32(le.Uint32(head[22:])))
+	if cfg.Height < 0 { // top-down
+		cfg.Height = -cfg.Height
+	}
+	if cfg.Width < 0 {
+		return cfg, errors.New("negative BMP width")
+	}
+	return cfg, nil
+}
+
+// icoConfig reads the dimensions of the largest image of an icon from its
+// directory, where 0 stands for 256.  Those of embedded PNG images aren't
+// limited to 256, so their own headers are read.
+func icoConfig(r io.Reader) (cfg image.Config, err error) {
+	buf, err := io.ReadAll(io.LimitReader(r, maxIcoSize))
+	if err != nil {
+		return cfg, err
+	}
+	if len(buf) < 6 {
+		return cfg, errors.New("truncated header")
+	}
+	cfg.ColorModel = color.RGBAModel
+	le := binary.LittleEndian
+	n := int(le.Uint16(buf[4:]))
+	if n == 0 || len(buf) < 6+16*n {
+		return cfg, errors.New("bad icon directory")
+	}
+	for i := range n {
+		e := buf[6+16*i:]
+		w, h := int(e[0]), int(e[1])
+		if w == 0 {
+			w = 256
+		}
+		if h == 0 {
+			h = 256
+		}
+		if off := int64(le.Uint32(e[12:])); off < int64(len(buf)) &&
+			bytes.HasPrefix(buf[off:], []byte("\x89PNG\r\n\x1a\n")) {
+
+			pc, err := png.DecodeConfig(bytes.NewReader(buf[off:]))
+			if err != nil {
+				return cfg, err
+			}
+			w, h = pc.Width, pc.Height
+		} else if off >= int64(len(buf)) {
+			return cfg, errors.New("icon image beyond the end of the file")
+		}
+		cfg.Width = max(cfg.Width, w)
+		cfg.Height = max(cfg.Height, h)
+	}
+	return cfg, nil
+}
+
+// maxIcoSize is the largest icon whose images icoConfig finds.
+const maxIcoSize = 16 << 20
+
+// isAnimatedGIF reports whether the GIF in r has more than one frame.  It
+// walks the blocks of the GIF rather than decoding it, stopping at the
+// second frame, so that a large animation costs no memory.
+func isAnimatedGIF(r io.Reader) (ok bool, err error) {
+	invalid := errors.New("invalid image: bad GIF")
+	br := bufio.NewReader(r)
+
+	// The header and the logical screen descriptor, with the size of the
+	// global color table.
+	head := make([]byte, 13)
+	if _, err = io.ReadFull(br, head); err != nil {
+		return false, invalid
+	}
+	if head[10]&0x80 != 0 {
+		if _, err = br.Discard(3 << (head[10]&7 + 1)); err != nil {
+			return false, invalid
+		}
+	}
+
+	// skipData skips data sub-blocks up to the terminating empty one.
+	skipData := func() (err error) {
+		for {
+			n, err := br.ReadByte()
+			if err != nil || n == 0 {
+				return err
+			}
+			if _, err = br.Discard(int(n)); err != nil {
+				return err
+			}
+		}
+	}
+
+	frames := 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return false, invalid
+		}
+		switch b {
+		case 0x21: // extension, with its label
+			if _, err = br.Discard(1); err == nil {
+				err = skipData()
+			}
+		case 0x2c: // image descriptor
+			if frames++; frames > 1 {
+				return true, nil
+			}
+			desc := make([]byte, 9)
+			if _, err = io.ReadFull(br, desc); err == nil && desc[8]&0x80 != 0 {
+				_, err = br.Discard(3 << (desc[8]&7 + 1)) // local color table
+			}
+			if err == nil {
+				_, err = br.Discard(1) // LZW minimum code size
+			}
+			if err == nil {
+				err = skipData()
+			}
+		case 0x3b: // trailer
+			return false, nil
+		default:
+			return false, invalid
+		}
+		if err != nil {
+			return false, invalid
+		}
+	}
+}
+
+// IsAnimated reports whether the image in r is animated: a GIF of more
+// than one frame, an animated WebP or an animated PNG.  The reader is
+// rewound afterwards.
+func IsAnimated(r io.ReadSeeker) (ok bool, err error) {
+	defer func() {
+		if _, serr := r.Seek(0, io.SeekStart); err == nil {
+			err = serr
+		}
+	}()
+
+	head := make([]byte, 21)
+	n, _ := io.ReadFull(r, head)
+	head = head[:n]
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("GIF8")):
+		return isAnimatedGIF(r)
+	case len(head) == 21 && string(head[:4]) == "RIFF" &&
+		string(head[8:16]) == "WEBPVP8X":
+
+		return head[20]&0x02 != 0, nil // the animation flag
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return isAPNG(r)
+	}
+	return false, nil
+}
+
+// isAPNG reports whether the PNG image in r has an acTL chunk before its
+// image data, which makes it animated.
+func isAPNG(r io.Reader) (ok bool, err error) {
+	br := bufio.NewReader(r)
+	if _, err = br.Discard(8); err != nil {
+		return false, err
+	}
+	for {
+		var hdr [8]byte
+		if _, err = io.ReadFull(br, hdr[:]); err != nil {
+			return false, nil
+		}
+		switch string(hdr[4:]) {
+		case "acTL":
+			return true, nil
+		case "IDAT", "IEND":
+			return false, nil
+		}
+		size := int(binary.BigEndian.Uint32(hdr[:4])) + 4 // and the CRC
+		if _, err = br.Discard(size); err != nil {
+			return false, nil
+		}
+	}
+}
+
+// Flatten returns the first frame of the animated GIF or PNG image in r,
+// in the same format.  Animated WebP images can't be decoded, so they can't
+// be flattened.
+func Flatten(r io.Reader) (buf []byte, err error) {
+	img, format, err := image.Decode(r)
+	if err == image.ErrFormat {
+		return nil, errors.New("can't flatten images of this format")
+	} else if err != nil {
+		return nil, errors.New("invalid image: " + err.Error())
+	}
+	var b bytes.Buffer
+	switch format {
+	case "gif":
+		err = gif.Encode(&b, img, nil)
+	case "png":
+		err = png.Encode(&b, img)
+	default:
+		return nil, errors.New("can't flatten " + format + " images")
+	}
+	return b.Bytes(), err
+}
+
+// HEICConverter is the shell command converting HEIC and HEIF images, as
+// taken by iPhones, to JPEG.  It gets the paths like ImgConverters, e.g.
+// heif-convert "$1" "$2".  Without it, such images are refused.
+var HEICConverter string
+
+// HEICLimits bounds the dimensions of HEIC images, which are only checked
+// once converted.
+var HEICLimits ImgLimits
+
+// ImgError is returned for an image found unacceptable only once copied,
+// such as a HEIC image too large once converted.
+type ImgError struct {
+	Err error
+}
+
+func (e *ImgError) Error() (s string) {
+	return e.Err.Error()
+}
+
+func (e *ImgError) Unwrap() (err error) {
+	return e.Err
+}
+
+// IsHEIC reports whether buf starts like a HEIC or HEIF image.
+func IsHEIC(buf []byte) bool {
+	if len(buf) < 12 || string(buf[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(buf[8:12]) {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// ctxReader fails reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Images are stored in two phases, so that the image directory and the
+// database stay consistent even if gobuffet dies halfway.  copyImg writes
+// the image to a file named after the image with PartSuffix appended, and
+// the image is recorded in the database under its final name.  Only once
+// that is committed does finishImg rename the file; if it isn't, dropImg
+// removes it.  Thus an image file without PartSuffix is always referenced
+// by the database, save for a replaced image that wasn't removed yet, and
+// a file with PartSuffix is left only by an interrupted upload, which
+// RecoverImgs finishes or removes.
+//
+// PartSuffix is appended to the name of an image file until the image is
+// committed to the database.
+const PartSuffix = ".part"
+
+// copyImg copies the image from r to dir in the image directory, giving up
+// and removing the partial file if ctx is done first.  Only the copy heeds
+// ctx: canceling a query would close the database connection.  The copy
+// must be finished with finishImg or dropped with dropImg.  HEIC images
+// are converted to JPEG with HEICConverter.
+func copyImg(ctx context.Context, dir, name string, r io.Reader) (img string, err error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(12)
+	heic := IsHEIC(head)
+	if heic {
+		if HEICConverter == "" {
+			return "", errors.New("HEIC images are not supported")
+		}
+		name = strings.TrimSuffix(name, path.Ext(name)) + ".jpg"
+	}
+
+	img = path.Join(dir, time.Now().Format("20060102_150405")+"_"+path.Base(name))
+	path := util.ImgPath(img) + PartSuffix
+	// The image directory may not exist yet if nothing has locked it,
+	// as when items are added from the command line on a fresh deploy.
+	if err = os.MkdirAll(util.ImgPath(dir), 0755); err != nil {
+		return "", err
+	}
+
+	src := path
+	if heic {
+		src += ".heic"
+	}
+	err = func() (err error) {
+		w, err := os.Create(src)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if _, err = io.Copy(w, ctxReader{ctx, br}); err != nil {
+			w.Close()
+			os.Remove(src)
+			return err
+		}
+		return nil
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	if heic {
+		defer os.Remove(src)
+		err = exec.CommandContext(ctx, "sh", "-c", HEICConverter, "sh", src, path).Run()
+		if err != nil {
+			os.Remove(path)
+			return "", errors.New("converting HEIC image: " + err.Error())
+		}
+		if err = checkFile(path, HEICLimits); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+	}
+	return img, nil
+}
+
+// checkFile checks the image in the file name with CheckImg, as an
+// ImgError.
+func checkFile(name string, lim ImgLimits) (err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = CheckImg(f, lim); err != nil {
+		return &ImgError{err}
+	}
+	return nil
+}
+
+// finishImg gives the copy of img its final name and converts it.
+func finishImg(img string) (err error) {
+	if err = os.Rename(util.ImgPath(img)+PartSuffix, util.ImgPath(img)); err != nil {
+		return err
+	}
+	convertImg(img)
+	return nil
+}
+
+// ImgFormats are the alternative formats an image may have, in order of
+// preference.  The file of an image in a format has its extension appended,
+// e.g. pizza.jpg.webp.
+var ImgFormats = []string{"avif", "webp"}
+
+// ImgConverters are the shell commands converting images to the formats
+// of ImgFormats, by format.  A command gets the path of the image as $1
+// and the path to write to as $2, e.g. cwebp -quiet "$1" -o "$2".
+var ImgConverters = map[string]string{}
+
+// ConvertTimeout is how long an image converter may run.
+const ConvertTimeout = time.Minute
+
+// convertImg makes the alternative formats of img.  They are optional, so
+// a failed conversion only leaves the format out.  The converters write to
+// a partial file first, so that an interrupted conversion is never served.
+func convertImg(img string) {
+	for _, f := range ImgFormats {
+		if cmd, ok := ImgConverters[f]; ok {
+			convertTo(img, f, cmd)
+		}
+	}
+}
+
+// convertTo makes the format f of img with the converter cmd.
+func convertTo(img, f, cmd string) (ok bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConvertTimeout)
+	defer cancel()
+	out := util.ImgPath(img) + "." + f
+	err := exec.CommandContext(ctx, "sh", "-c", cmd, "sh", util.ImgPath(img),
+		out+PartSuffix).Run()
+	if err == nil {
+		err = os.Rename(out+PartSuffix, out)
+	}
+	if err != nil {
+		os.Remove(out + PartSuffix)
+		return false
+	}
+	return true
+}
+
+// ConvertImgs makes the alternative formats that the images in the image
+// directory lack, as do those added while ImgConverters was empty, e.g.
+// from the command line.  It returns the images converted to some format.
+func ConvertImgs() (converted []string, err error) {
+	err = filepath.WalkDir(util.ImgPath(""), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") ||
+			ImgType(p) == "" {
+
+			return err
+		}
+		for _, f := range ImgFormats {
+			// Alternative formats aren't converted themselves.
+			if base, ok := strings.CutSuffix(p, "."+f); ok {
+				if _, err := os.Stat(base); err == nil {
+					return nil
+				}
+			}
+		}
+
+		img := strings.TrimPrefix(filepath.ToSlash(p), util.ImgPath(""))
+		done := false
+		for _, f := range ImgFormats {
+			cmd, ok := ImgConverters[f]
+			if !ok {
+				continue
+			}
+			if _, err := os.Stat(p + "." + f); err == nil {
+				continue
+			}
+			if convertTo(img, f, cmd) {
+				done = true
+			}
+		}
+		if done {
+			converted = append(converted, img)
+		}
+		return nil
+	})
+	return converted, err
+}
+
+// removeImg removes img along with its alternative formats.
+func removeImg(img string) {
+	os.Remove(util.ImgPath(img))
+	for _, f := range ImgFormats {
+		os.Remove(util.ImgPath(img) + "." + f)
+	}
+}
+
+// dropImg removes the copy of img.
+func dropImg(img string) {
+	os.Remove(util.ImgPath(img) + PartSuffix)
+}
+
+// StageImg copies the image from r to dir in the image directory as
+// copyImg does, to be given to an item later, by Add or Mod with
+// Img.Staged.  Until then, the copy is like that of an interrupted upload,
+// and RecoverImgs removes it.
+func StageImg(ctx context.Context, dir, name string, r io.Reader) (img string, err error) {
+	return copyImg(ctx, dir, name, r)
+}
+
+// CheckStaged checks that img is an image staged by StageImg and not yet
+// given to an item.
+func CheckStaged(img string) (err error) {
+	if img != path.Clean(img) || path.IsAbs(img) || strings.HasPrefix(img, "..") {
+		return errors.New("invalid image name: " + img)
+	}
+	if _, err = os.Stat(util.ImgPath(img) + PartSuffix); err != nil {
+		return errors.New("no staged image " + img)
+	}
+	return nil
+}
+
+// RecoverImgs goes through the image files in dir left by interrupted
+// uploads, finishing those whose image is in the database and removing the
+// rest.  Uploads in progress are interrupted too, so nothing else may use
+// dir in the meantime.
+func RecoverImgs(db util.DB, dir string) (finished, removed []string, err error) {
+	err = filepath.WalkDir(util.ImgPath(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, PartSuffix) {
+			return err
+		}
+		img := strings.TrimPrefix(strings.TrimSuffix(filepath.ToSlash(p), PartSuffix),
+			util.ImgPath(""))
+
+		var used bool
+		err = db.QueryRow(context.Background(), `SELECT
+			EXISTS (SELECT 1 FROM items WHERE img = $1) OR
+			EXISTS (SELECT 1 FROM branding WHERE img = $1)`, img).Scan(&used)
+		if err != nil {
+			return err
+		}
+		if used {
+			if err = finishImg(img); err != nil {
+				return err
+			}
+			finished = append(finished, img)
+		} else {
+			if err = os.Remove(p); err != nil {
+				return err
+			}
+			removed = append(removed, img)
+		}
+		return nil
+	})
+	return finished, removed, err
+}
+
+// Kinds of branding images.
+const (
+	Logo    = "logo"
+	Favicon = "favicon"
+)
+
+// SetBranding stores the image read from r in dir as the shop's branding
+// image of the given kind, replacing the previous one.
+func SetBranding(ctx context.Context, db util.DB, kind, dir, name string,
+	r io.Reader) (err error) {
+
+	img, err := copyImg(ctx, dir, name, r)
+	if err != nil {
+		return err
+	}
+
+	var old *string
+	err = db.QueryRow(context.Background(),
+		"SELECT img FROM branding WHERE kind = $1", kind).Scan(&old)
+	if err != nil && err != pgx.ErrNoRows {
+		dropImg(img)
+		return err
+	}
+
+	_, err = db.Exec(context.Background(), `INSERT INTO branding (kind, img)
+		VALUES ($1, $2) ON CONFLICT (kind) DO UPDATE SET img = $2`, kind, img)
+	if err != nil {
+		dropImg(img)
+		return err
+	}
+	if err = finishImg(img); err != nil {
+		return err
+	}
+	if old != nil {
+		removeImg(*old)
+	}
+
+	return nil
+}
+
+// Branding returns the branding images by kind.
+func Branding(db util.DB) (imgs map[string]string, err error) {
+	rows, err := db.Query(context.Background(), "SELECT kind, img FROM branding")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	imgs = make(map[string]string)
+	for rows.Next() {
+		var kind, img string
+		if err = rows.Scan(&kind, &img); err != nil {
+			return nil, err
+		}
+		imgs[kind] = img
+	}
+	return imgs, rows.Err()
+}
+
+// setVariants replaces the variants of the item matching where, which must
+// refer to whereArg as $1.
+func setVariants(tx pgx.Tx, where string, whereArg any, vs []Variant) (err error) {
+	_, err = tx.Exec(context.Background(),
+		"DELETE FROM variants WHERE item_id IN (SELECT id FROM items WHERE "+where+")",
+		whereArg)
+	if err != nil {
+		return err
+	}
+	for i, v := range vs {
+		_, err = tx.Exec(context.Background(),
+			`INSERT INTO variants (item_id, label, price, ord)
+			SELECT id, $2, $3, $4 FROM items WHERE `+where, whereArg, v.Label, v.Price, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setModifiers is the setVariants of modifiers.
+func setModifiers(tx pgx.Tx, where string, whereArg any, ms []Modifier) (err error) {
+	_, err = tx.Exec(context.Background(),
+		"DELETE FROM modifiers WHERE item_id IN (SELECT id FROM items WHERE "+where+")",
+		whereArg)
+	if err != nil {
+		return err
+	}
+	for i, m := range ms {
+		_, err = tx.Exec(context.Background(),
+			`INSERT INTO modifiers (item_id, label, price, multi, ord)
+			SELECT id, $2, $3, $4, $5 FROM items WHERE `+where,
+			whereArg, m.Label, m.Price, m.Multi, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NameTakenError is returned by Add and Mod if another item has the name.
+type NameTakenError struct {
+	Name string
+}
+
+func (e *NameTakenError) Error() (s string) {
+	return "an item named " + e.Name + " already exists"
+}
+
+// nameTaken turns a violation of the unique item names into a
+// NameTakenError.
+func nameTaken(dbErr error, name string) (err error) {
+	var pgErr *pgconn.PgError
+	if errors.As(dbErr, &pgErr) && pgErr.Code == "23505" && // unique_violation
+		pgErr.ConstraintName == "items_name_key" {
+
+		return &NameTakenError{Name: name}
+	}
+	return dbErr
+}
+
+// Add adds it and returns its ID, which it also sets in it.
+func Add(ctx context.Context, db util.DB, it *Item) (id int, err error) {
+	items := []Item{*it}
+	if err = AddBatch(ctx, db, items); err != nil {
+		return -1, err
+	}
+	*it = items[0]
+	return *it.ID, nil
+}
+
+// AddBatch adds all the items in a single transaction, setting their IDs.
+// If any of them fails, none are added and the copied images are removed.
+// Copying the images stops once ctx is done.
+func AddBatch(ctx context.Context, db util.DB, items []Item) (err error) {
+	var imgs []string
+
+	// Staged images are kept on failure, to be given to another try.
+	defer func() {
+		if err != nil {
+			for _, v := range imgs {
+				dropImg(v)
+			}
+		}
+	}()
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	for i := range items {
+		img, err := add(ctx, tx, &items[i])
+		if img != "" {
+			imgs = append(imgs, img)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return err
+	}
+
+	// The items are in, and refer to the images, so an image not renamed
+	// is left to RecoverImgs rather than dropped.
+	for i := range items {
+		if it := &items[i]; it.Img.Staged {
+			imgs = append(imgs, *it.Img.Name)
+		}
+	}
+	for _, v := range imgs {
+		if err := finishImg(v); err != nil {
+			log.Print("finishing image: ", err)
+		}
+	}
+	return nil
+}
+
+// csvColumns are the columns ReadCSV knows, the first two required.
+var csvColumns = []string{"name", "price", "descr", "vat", "maxqty", "slug", "img"}
+
+// ReadCSV reads items from r as CSV, whose header line names the columns
+// of csvColumns, in any order.  Every row is checked, and what is wrong
+// with them is returned as one error per field, e.g. line 3: price:
+// invalid price.  Images are given by the path of their file, which is
+// checked to be an image but left for the caller to open as the reader
+// of Img.
+func ReadCSV(r io.Reader) (items []Item, errs []error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	head, err := cr.Read()
+	if err != nil {
+		return nil, []error{errors.New("reading the header: " + err.Error())}
+	}
+	col := make(map[string]int)
+	for i, h := range head {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if !slices.Contains(csvColumns, h) {
+			return nil, []error{errors.New("unknown column " + h)}
+		}
+		col[h] = i
+	}
+	for _, h := range csvColumns[:2] {
+		if _, ok := col[h]; !ok {
+			return nil, []error{errors.New("no " + h + " column")}
+		}
+	}
+
+	names := make(map[string]int)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+			return nil, errs
+		}
+		line, _ := cr.FieldPos(0)
+		fail := func(fld string, err error) {
+			errs = append(errs, fmt.Errorf("line %v: %v: %w", line, fld, err))
+		}
+		get := func(h string) (v string, ok bool) {
+			i, ok := col[h]
+			if !ok || rec[i] == "" {
+				return "", false
+			}
+			return rec[i], true
+		}
+
+		var it Item
+		if name, ok := get("name"); !ok {
+			fail("name", errors.New("required"))
+		} else if l, ok := names[strings.ToLower(name)]; ok {
+			fail("name", fmt.Errorf("%v also on line %v", name, l))
+		} else {
+			names[strings.ToLower(name)] = line
+			it.Name = &name
+		}
+		if v, ok := get("price"); !ok {
+			fail("price", errors.New("required"))
+		} else if n, err := Cur.Parse(v); err != nil {
+			fail("price", err)
+		} else {
+			it.Price = &n
+		}
+		if v, ok := get("descr"); ok {
+			it.Descr = &v
+		}
+		if v, ok := get("vat"); ok {
+			if n, err := ParseRate(v); err != nil {
+				fail("vat", err)
+			} else {
+				it.VAT = &n
+			}
+		}
+		if v, ok := get("maxqty"); ok {
+			if n, err := strconv.Atoi(v); err != nil || n < 0 {
+				fail("maxqty", errors.New("invalid quantity"))
+			} else {
+				it.MaxQty = &n
+			}
+		}
+		if v, ok := get("slug"); ok {
+			it.Slug = &v
+		}
+		if v, ok := get("img"); ok {
+			if fi, err := os.Stat(v); err != nil {
+				fail("img", err)
+			} else if !fi.Mode().IsRegular() || ImgType(v) == "" {
+				fail("img", errors.New("not an image file: "+v))
+			} else {
+				it.Img.Name = &v
+			}
+		}
+		items = append(items, it)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return items, nil
+}
+
+// syncIDSeq moves the identity sequence of the items past their highest
+// ID.  An explicit ID doesn't advance it, so it would later give the ID out
+// again.
+func syncIDSeq(tx pgx.Tx) (err error) {
+	_, err = tx.Exec(context.Background(), `SELECT setval(
+		pg_get_serial_sequence('items', 'id'),
+		GREATEST((SELECT max(id) FROM items), 1))`)
+	return err
+}
+
+// add inserts it within tx, returning the copied image, if any.
+func add(ctx context.Context, tx pgx.Tx, it *Item) (img string, err error) {
+	cols := []string{"name", "price"}
+	vals := []string{"$1", "$2"}
+	args := []any{it.Name, it.Price}
+
+	addArg := func(fld string, arg any) {
+		cols = append(cols, fld)
+		vals = append(vals, fmt.Sprintf("$%v", len(cols)))
+		args = append(args, arg)
+	}
+
+	slug := *it.Name
+	if it.Slug != nil && *it.Slug != "" {
+		slug = *it.Slug
+	}
+	if slug, err = uniqueSlug(tx, slug, Or(it.ID, 0)); err != nil {
+		return "", err
+	}
+	addArg("slug", slug)
+
+	if it.Img.Staged {
+		if err = CheckStaged(*it.Img.Name); err != nil {
+			return "", err
+		}
+		addArg("img", *it.Img.Name)
+	} else if it.Img.Reader != nil {
+		if img, err = copyImg(ctx, it.Img.Dir, *it.Img.Name, it.Img.Reader); err != nil {
+			return "", err
+		}
+		addArg("img", img)
+	}
+	if it.Descr != nil {
+		addArg("descr", it.Descr)
+	}
+	if it.VAT != nil {
+		addArg("vat_rate", *it.VAT)
+	}
+	if it.MaxQty != nil && *it.MaxQty > 0 {
+		addArg("max_qty", *it.MaxQty)
+	}
+
+	if it.ID != nil {
+		addArg("id", *it.ID)
+	}
+
+	var id int
+	err = tx.QueryRow(context.Background(),
+		fmt.Sprintf("INSERT INTO items (%v) VALUES (%v) RETURNING id",
+			strings.Join(cols, ","), strings.Join(vals, ",")), args...).Scan(&id)
+	if err != nil {
+		return img, nameTaken(err, *it.Name)
+	}
+	if it.ID != nil {
+		if err = syncIDSeq(tx); err != nil {
+			return img, err
+		}
+	}
+	it.ID = &id
+	it.Slug = &slug
+	if len(it.Variants) > 0 {
+		if err = setVariants(tx, "name = $1", *it.Name, it.Variants); err != nil {
+			return img, err
+		}
+	}
+	if len(it.Modifiers) > 0 {
+		if err = setModifiers(tx, "name = $1", *it.Name, it.Modifiers); err != nil {
+			return img, err
 		}
-		return nil
-	}()
-	if err != nil {
-		return "", err
 	}
 	return img, nil
 }
 
-func Add(db *pgx.Conn, it *Item) (err error) {
-	var img, imgPath string
-	cols := []string{"name", "price"}
-	vals := []string{"$1", "$2"}
-	args := []any{it.Name, it.Price}
-
-	addArg := func(fld string, arg any) {
-		cols = append(cols, fld)
-		vals = append(vals, fmt.Sprintf("$%v", len(cols)))
-		args = append(args, arg)
-	}
-
-	if it.Img.Reader != nil {
-		img, err = copyImg(*it.Img.Name, it.Img.Reader)
-		if err != nil {
-			return err
+// Slug turns s, e.g. an item name, into a URL path element: the letters
+// and digits of s in lower case, with a dash for each run of anything
+// else between them.  Slugs of digits alone, which would be taken for
+// IDs, and empty ones get an item- prefix.
+func Slug(s string) (slug string) {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(s) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
 		}
-		imgPath = util.ImgPath(img)
-		addArg("img", img)
 	}
-	if it.Descr != nil {
-		addArg("descr", it.Descr)
+	slug = b.String()
+	if _, err := strconv.Atoi(slug); err == nil || slug == "" {
+		slug = strings.TrimSuffix("item-"+slug, "-")
 	}
-	_, err = db.Exec(context.Background(), fmt.Sprintf("INSERT INTO items (%v) VALUES (%v)",
-		strings.Join(cols, ","), strings.Join(vals, ",")), args...)
+	return slug
+}
+
+// uniqueSlug returns Slug(s), with the lowest suffix -2, -3 ... needed
+// for no item but the one with the given id to have it.
+func uniqueSlug(tx pgx.Tx, s string, id int) (slug string, err error) {
+	base := Slug(s)
+	rows, err := tx.Query(context.Background(),
+		"SELECT slug FROM items WHERE (slug = $1 OR slug LIKE $2) AND id <> $3",
+		base, base+"-%", id)
 	if err != nil {
-		if img != "" {
-			os.Remove(imgPath)
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return "", err
 		}
-		return err
+		taken[s] = true
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
 	}
 
-	return nil
+	slug = base
+	for n := 2; taken[slug]; n++ {
+		slug = fmt.Sprintf("%v-%v", base, n)
+	}
+	return slug, nil
 }
 
-func Del(db *pgx.Conn, ids []int, names []string) (err error) {
-	if len(ids) == 0 && len(names) == 0 {
-		return nil
+// FillSlugs gives the items without slugs, added before there were any,
+// slugs of their names, returning how many it gave.
+func FillSlugs(db util.DB) (n int, err error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback(context.Background())
 
-	var where, imgs []string
-	var args []any
-
-	newArg := func(fld string, arg any) {
-		where = append(where, fmt.Sprintf("%v = $%v", fld, len(where)+1))
-		args = append(args, arg)
+	rows, err := tx.Query(context.Background(),
+		"SELECT id, name FROM items WHERE slug IS NULL ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	names := make(map[int]string)
+	var ids []int
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		names[id] = name
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
 	}
 
 	for _, id := range ids {
-		newArg("id", id)
+		slug, err := uniqueSlug(tx, names[id], id)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(context.Background(),
+			"UPDATE items SET slug = $1 WHERE id = $2", slug, id)
+		if err != nil {
+			return 0, err
+		}
 	}
-	for _, n := range names {
-		newArg("name", n)
+	return len(ids), tx.Commit(context.Background())
+}
+
+// Del deletes the items with the given IDs or names in one transaction,
+// returning how many were deleted.
+func Del(db util.DB, ids []int, names []string) (n int, err error) {
+	if len(ids) == 0 && len(names) == 0 {
+		return 0, nil
 	}
 
+	var imgs []string
+	wheres, args := matchItems(ids, names, nil)
+
 	tx, err := db.Begin(context.Background())
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer tx.Rollback(context.Background())
 
-	wheres := strings.Join(where, " OR ")
 	rows, err := tx.Query(context.Background(), "SELECT img FROM items WHERE "+wheres, args...)
 	if err != nil && err != pgx.ErrNoRows {
-		return err
+		return 0, err
 	}
 	for rows.Next() {
 		var p *string
 		if err := rows.Scan(&p); err != nil {
-			return err
+			return 0, err
 		}
 		if p != nil {
-			imgs = append(imgs, util.ImgPath(*p))
+			imgs = append(imgs, *p)
 		}
 	}
-	_, err = tx.Exec(context.Background(), "DELETE FROM items WHERE "+wheres, args...)
+	tag, err := tx.Exec(context.Background(), "DELETE FROM items WHERE "+wheres, args...)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return 0, err
 	}
-	tx.Commit(context.Background())
 
 	for _, v := range imgs {
-		os.Remove(v)
+		removeImg(v)
 	}
 
-	return nil
+	return int(tag.RowsAffected()), nil
 }
 
-func Mod(db *pgx.Conn, id int, name string, it *Item) (err error) {
-	var where, img, newImg, newImgPath string
+// ErrNoChange is returned by Mod if the item has nothing to change.
+var ErrNoChange = errors.New("nothing to update")
+
+// ErrNoItem is returned by Mod if there is no such item.
+var ErrNoItem = errors.New("no such item")
+
+func Mod(ctx context.Context, db util.DB, id int, name string, it *Item) (err error) {
+	if it.ID == nil && it.Name == nil && it.Price == nil && it.VAT == nil &&
+		it.MaxQty == nil && it.Img.Name == nil && it.Descr == nil &&
+		it.Variants == nil && it.Modifiers == nil && it.Slug == nil {
+
+		return ErrNoChange
+	}
+
+	var where, whereFld, newImg, staged string
+	var img *string
 	var set []string
 	var args []any
 	var whereArg any
@@ -219,8 +1830,8 @@ func Mod(db *pgx.Conn, id int, name string, it *Item) (err error) {
 	}
 
 	rmImg := func() {
-		if newImgPath != "" {
-			os.Remove(newImgPath)
+		if newImg != "" {
+			dropImg(newImg)
 		}
 	}
 
@@ -236,15 +1847,32 @@ func Mod(db *pgx.Conn, id int, name string, it *Item) (err error) {
 		newArg("price", it.Price)
 	}
 
+	if it.VAT != nil {
+		newArg("vat_rate", *it.VAT)
+	}
+
+	if it.MaxQty != nil {
+		if *it.MaxQty == 0 {
+			newArg("max_qty", nil)
+		} else {
+			newArg("max_qty", *it.MaxQty)
+		}
+	}
+
 	if it.Img.Name != nil {
 		if *it.Img.Name == "" {
 			newArg("img", nil)
+		} else if it.Img.Staged {
+			if err = CheckStaged(*it.Img.Name); err != nil {
+				return err
+			}
+			staged = *it.Img.Name
+			newArg("img", staged)
 		} else {
-			newImg, err = copyImg(*it.Img.Name, it.Img.Reader)
+			newImg, err = copyImg(ctx, it.Img.Dir, *it.Img.Name, it.Img.Reader)
 			if err != nil {
 				return err
 			}
-			newImgPath = util.ImgPath(img)
 			newArg("img", newImg)
 		}
 	}
@@ -258,12 +1886,13 @@ func Mod(db *pgx.Conn, id int, name string, it *Item) (err error) {
 	}
 
 	if id >= 0 {
-		where = fmt.Sprintf("id = $%v", len(set)+1)
+		whereFld = "id"
 		whereArg = id
 	} else {
-		where = fmt.Sprintf("name = $%v", len(set)+1)
+		whereFld = "name"
 		whereArg = name
 	}
+	where = fmt.Sprintf("%v = $%v", whereFld, len(set)+1)
 	args = append(args, whereArg)
 
 	tx, err := db.Begin(context.Background())
@@ -274,44 +1903,196 @@ func Mod(db *pgx.Conn, id int, name string, it *Item) (err error) {
 
 	if it.Img.Name != nil {
 		err := tx.QueryRow(context.Background(),
-			"SELECT img FROM items WHERE "+where, whereArg).Scan(&img)
+			"SELECT img FROM items WHERE "+whereFld+" = $1", whereArg).Scan(&img)
 		if err != nil && err != pgx.ErrNoRows {
 			rmImg()
 			return err
 		}
 	}
 
-	if _, err := tx.Exec(context.Background(), fmt.Sprintf("UPDATE items SET %v WHERE %v",
-		strings.Join(set, ","), where), args...); err != nil {
+	// Variants and modifiers go first, while where still matches the old
+	// ID and name.
+	if it.Variants != nil {
+		if err := setVariants(tx, whereFld+" = $1", whereArg, it.Variants); err != nil {
+			rmImg()
+			return err
+		}
+	}
+	if it.Modifiers != nil {
+		err := setModifiers(tx, whereFld+" = $1", whereArg, it.Modifiers)
+		if err != nil {
+			rmImg()
+			return err
+		}
+	}
 
+	set = append(set, "updated_at = now()")
+	var newID int
+	var newName string
+	err = tx.QueryRow(context.Background(),
+		fmt.Sprintf("UPDATE items SET %v WHERE %v RETURNING id, name",
+			strings.Join(set, ","), where), args...).Scan(&newID, &newName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		rmImg()
+		return ErrNoItem
+	} else if err != nil {
+		rmImg()
+		if it.Name != nil {
+			err = nameTaken(err, *it.Name)
+		}
+		return err
+	}
+	if it.ID != nil {
+		if err = syncIDSeq(tx); err != nil {
+			rmImg()
+			return err
+		}
+	}
+	if it.Slug != nil {
+		slug := *it.Slug
+		if slug == "" {
+			slug = newName
+		}
+		if slug, err = uniqueSlug(tx, slug, newID); err == nil {
+			_, err = tx.Exec(context.Background(),
+				"UPDATE items SET slug = $1 WHERE id = $2", slug, newID)
+		}
+		if err != nil {
+			rmImg()
+			return err
+		}
+	}
+	if err = tx.Commit(context.Background()); err != nil {
 		rmImg()
 		return err
 	}
-	tx.Commit(context.Background())
 
-	if img != "" {
-		os.Remove(util.ImgPath(img))
+	if newImg != "" {
+		if err = finishImg(newImg); err != nil {
+			return err
+		}
+	}
+	if staged != "" {
+		if err = finishImg(staged); err != nil {
+			return err
+		}
+	}
+	if img != nil {
+		removeImg(*img)
 	}
 
 	return nil
 }
 
+// RepriceOp multiplies a price by Mul and then adds Add.  Prices never go
+// below zero.
+type RepriceOp struct {
+	Mul float64
+	Add int
+}
+
+type Repriced struct {
+	ID       int
+	Name     string
+	Old, New int
+}
+
+// Reprice applies op to the prices of the matching items and their variants,
+// or to all items if no IDs or names are given.  It returns the changes to
+// the item prices; with dryRun, the prices aren't actually changed.
+func Reprice(db util.DB, ids []int, names []string, op RepriceOp,
+	dryRun bool) (changes []Repriced, err error) {
+
+	wheres, args := matchItems(ids, names, []any{op.Mul, op.Add})
+	expr := "GREATEST(0, ROUND(price * $1::numeric)::int + $2::int)"
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	rows, err := tx.Query(context.Background(), "SELECT id, name, price, "+expr+
+		" FROM items WHERE "+wheres+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c Repriced
+		if err := rows.Scan(&c.ID, &c.Name, &c.Old, &c.New); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || dryRun {
+		return changes, err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE items SET price = "+expr+
+		", updated_at = now() WHERE "+wheres, args...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE variants SET price = "+expr+
+		" WHERE item_id IN (SELECT id FROM items WHERE "+wheres+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
 type Order int
 
 const (
 	ByID Order = iota
 	ByName
+	ByPrice
+	// ByRelevance puts the results of a search matching its start first.
+	// Outside a search it is ByName.
+	ByRelevance
 )
 
-func Get(db *pgx.Conn, ids []int, names []string, ord Order) (items []Item, err error) {
-	var orderBy string
-	var where []string
-	var args []any
-	sql := "SELECT id, name, descr, price, img FROM items"
+var orderNames = []string{ByID: "id", ByName: "name", ByPrice: "price",
+	ByRelevance: "relevance"}
+
+// ParseOrder parses the name of an order: id, name, price or relevance.
+func ParseOrder(s string) (ord Order, err error) {
+	for i, n := range orderNames {
+		if n == s {
+			return Order(i), nil
+		}
+	}
+	return ByID, errors.New("invalid order " + s +
+		" (must be id, name, price or relevance)")
+}
+
+func (ord *Order) Set(s string) (err error) {
+	*ord, err = ParseOrder(s)
+	return err
+}
+
+func (ord *Order) String() (s string) {
+	if int(*ord) < len(orderNames) {
+		return orderNames[*ord]
+	}
+	return ""
+}
+
+// matchItems makes a condition matching the items with any of ids or names,
+// or all items if there are none.  Its parameters are numbered after args,
+// which it appends to.
+func matchItems(ids []int, names []string, args []any) (where string, allArgs []any) {
+	var conds []string
 
 	newArg := func(fld string, arg any) {
-		where = append(where, fmt.Sprintf("%v = $%v", fld, len(where)+1))
 		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf("%v = $%v", fld, len(args)))
 	}
 
 	for _, id := range ids {
@@ -320,22 +2101,202 @@ func Get(db *pgx.Conn, ids []int, names []string, ord Order) (items []Item, err
 	for _, n := range names {
 		newArg("name", n)
 	}
-	if len(where) > 0 {
-		sql += " WHERE"
+	if len(conds) == 0 {
+		return "TRUE", args
 	}
+	return strings.Join(conds, " OR "), args
+}
 
+// orderBy returns the ORDER BY clause for ord, with a leading space.
+func orderBy(ord Order) (clause string) {
 	switch ord {
 	case ByID:
-		orderBy = "id"
-	case ByName:
-		orderBy = "name"
+		return " ORDER BY id"
+	case ByName, ByRelevance:
+		return " ORDER BY name"
+	case ByPrice:
+		return " ORDER BY price, name"
+	}
+	return ""
+}
+
+// PriceRange limits items to the prices from Min to Max, inclusive.  A
+// negative bound is no bound.
+type PriceRange struct {
+	Min, Max int
+}
+
+// AnyPrice is the PriceRange of all prices.
+var AnyPrice = PriceRange{-1, -1}
+
+// where makes a condition of pr, numbering its parameters after args,
+// which it appends to.
+func (pr PriceRange) where(args []any) (cond string, allArgs []any) {
+	cond = "TRUE"
+	if pr.Min >= 0 {
+		args = append(args, pr.Min)
+		cond += fmt.Sprintf(" AND price >= $%v", len(args))
+	}
+	if pr.Max >= 0 {
+		args = append(args, pr.Max)
+		cond += fmt.Sprintf(" AND price <= $%v", len(args))
+	}
+	return cond, args
+}
+
+// getSQL builds the query of GetIn.
+func getSQL(ids []int, names []string, pr PriceRange, ord Order) (sql string, args []any) {
+	where, args := matchItems(ids, names, nil)
+	prWhere, args := pr.where(args)
+	return "SELECT id, name, descr, price, vat_rate, img, updated_at, sold_out_until, " +
+		"max_qty, slug FROM items WHERE (" + where + ") AND " + prWhere + orderBy(ord), args
+}
+
+func Get(db util.DB, ids []int, names []string, ord Order) (items []Item, err error) {
+	return GetIn(db, ids, names, AnyPrice, ord)
+}
+
+// GetIn is like Get, but only returns the items with prices in pr.
+func GetIn(db util.DB, ids []int, names []string, pr PriceRange,
+	ord Order) (items []Item, err error) {
+
+	sql, args := getSQL(ids, names, pr, ord)
+	return query(db, sql, args...)
+}
+
+// EachIn calls f with each of the items GetIn would return, as its row
+// arrives, so that the items needn't all be in memory at once.  f must not
+// use db, which is busy with the query until EachIn returns.  An error from
+// f stops EachIn, which returns it.
+func EachIn(db util.DB, ids []int, names []string, pr PriceRange, ord Order,
+	f func(it *Item) error) (err error) {
+
+	where, args := matchItems(ids, names, nil)
+	prWhere, args := pr.where(args)
+	rows, err := db.Query(context.Background(), `SELECT id, name, descr, price,
+		vat_rate, img, updated_at, sold_out_until, max_qty, slug,
+		(SELECT json_agg(json_build_object('label', label, 'price', price)
+			ORDER BY ord) FROM variants WHERE item_id = items.id),
+		(SELECT json_agg(json_build_object('label', label, 'price', price,
+			'multi', multi) ORDER BY ord) FROM modifiers WHERE item_id = items.id),
+		(SELECT json_object_agg(lang, json_build_object('name', coalesce(name, ''),
+			'descr', coalesce(descr, ''))) FROM item_translations
+			WHERE item_id = items.id)
+		FROM items WHERE (`+where+") AND "+prWhere+orderBy(ord), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var it Item
+		var until *time.Time
+		var vs, ms, trs []byte
+		if err := rows.Scan(&it.ID, &it.Name, &it.Descr, &it.Price, &it.VAT,
+			&it.Img.Name, &it.Updated, &until, &it.MaxQty, &it.Slug,
+			&vs, &ms, &trs); err != nil {
+
+			return err
+		}
+		if until != nil {
+			it.SoldOutUntil = *until
+		}
+		for _, x := range []struct {
+			b []byte
+			v any
+		}{{vs, &it.Variants}, {ms, &it.Modifiers}, {trs, &it.Translations}} {
+			if x.b == nil {
+				continue
+			}
+			if err := json.Unmarshal(x.b, x.v); err != nil {
+				return err
+			}
+		}
+		if err := f(&it); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Search returns the items whose name or description contains q, ignoring
+// case.  By ByRelevance, the items named q come first, then those whose
+// names start with q, then those whose names contain it, and then the
+// rest, each by name.
+func Search(db util.DB, q string, ord Order) (items []Item, err error) {
+	return SearchIn(db, q, AnyPrice, ord)
+}
+
+// SearchIn is like Search, but only returns the items with prices in pr.
+func SearchIn(db util.DB, q string, pr PriceRange, ord Order) (items []Item, err error) {
+	esc := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q)
+	prWhere, args := pr.where([]any{"%" + esc + "%"})
+	order := orderBy(ord)
+	if ord == ByRelevance {
+		args = append(args, q, esc+"%")
+		order = fmt.Sprintf(` ORDER BY CASE WHEN lower(name) = lower($%v) THEN 0
+			WHEN name ILIKE $%v THEN 1 WHEN name ILIKE $1 THEN 2 ELSE 3 END, name`,
+			len(args)-1, len(args))
 	}
-	if orderBy != "" {
-		orderBy = "ORDER BY " + orderBy
+	return query(db, `SELECT id, name, descr, price, vat_rate, img, updated_at,
+		sold_out_until, max_qty, slug FROM items
+		WHERE (name ILIKE $1 OR descr ILIKE $1) AND `+prWhere+order, args...)
+}
+
+// GetSlug returns the item with the given slug, if there is one.
+func GetSlug(db util.DB, slug string) (items []Item, err error) {
+	return query(db, `SELECT id, name, descr, price, vat_rate, img, updated_at,
+		sold_out_until, max_qty, slug FROM items WHERE slug = $1`, slug)
+}
+
+// SoldOut reports whether the item is sold out at t.
+func (it *Item) SoldOut(t time.Time) bool {
+	return it.SoldOutUntil.After(t)
+}
+
+// SetSoldOut marks the item with the given id as sold out until the given
+// time, after which it is available again by itself.  The zero time makes
+// it available right away.
+func SetSoldOut(db util.DB, id int, until time.Time) (err error) {
+	var arg any
+	if !until.IsZero() {
+		arg = until
 	}
+	_, err = db.Exec(context.Background(),
+		"UPDATE items SET sold_out_until = $1 WHERE id = $2", arg, id)
+	return err
+}
+
+// ItemStats are counts of the items, and of the orders of the day.
+type ItemStats struct {
+	Items     int `json:"items"`
+	Available int `json:"available"`
+	SoldOut   int `json:"sold_out"`
+	WithImg   int `json:"with_img"`
+	Orders    int `json:"orders"` // placed today and not canceled
+}
+
+// Stats counts the items as of t, and the orders placed on the day of
+// t, in the location of t.
+func Stats(db util.DB, t time.Time) (s ItemStats, err error) {
+	from := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	to := from.AddDate(0, 0, 1)
+
+	err = db.QueryRow(context.Background(),
+		`SELECT count(*), count(*) FILTER (WHERE sold_out_until > $1),
+		count(img), (SELECT count(*) FROM orders
+			WHERE created_at >= $2 AND created_at < $3
+			AND canceled_at IS NULL)
+		FROM items`, t, from, to).
+		Scan(&s.Items, &s.SoldOut, &s.WithImg, &s.Orders)
+	s.Available = s.Items - s.SoldOut
+	return s, err
+}
 
-	rows, err := db.Query(context.Background(), sql+" "+strings.Join(where, " OR ")+" "+orderBy,
-		args...)
+// query runs an item query selecting id, name, descr, price, vat_rate, img,
+// updated_at, sold_out_until and max_qty.
+func query(db util.DB, sql string, args ...any) (items []Item, err error) {
+	rows, err := db.Query(context.Background(), sql, args...)
 	if err != nil && err != pgx.ErrNoRows {
 		return items, err
 	}
@@ -343,12 +2304,126 @@ func Get(db *pgx.Conn, ids []int, names []string, ord Order) (items []Item, err
 
 	for rows.Next() {
 		var it Item
-		if err := rows.Scan(&it.ID, &it.Name, &it.Descr, &it.Price,
-			&it.Img.Name); err != nil {
+		var until *time.Time
+		if err := rows.Scan(&it.ID, &it.Name, &it.Descr, &it.Price, &it.VAT,
+			&it.Img.Name, &it.Updated, &until, &it.MaxQty, &it.Slug); err != nil {
 
 			return items, err
 		}
+		if until != nil {
+			it.SoldOutUntil = *until
+		}
 		items = append(items, it)
 	}
-	return items, nil
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return items, err
+	}
+
+	return items, getExtras(db, items)
+}
+
+// getExtras fills in the variants and modifiers of items.
+func getExtras(db util.DB, items []Item) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Item)
+	ids := make([]int, 0, len(items))
+	for i := range items {
+		byID[*items[i].ID] = &items[i]
+		ids = append(ids, *items[i].ID)
+	}
+
+	err = func() (err error) {
+		rows, err := db.Query(context.Background(), `SELECT item_id, label, price
+			FROM variants WHERE item_id = ANY($1) ORDER BY item_id, ord`, ids)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int
+			var v Variant
+			if err := rows.Scan(&id, &v.Label, &v.Price); err != nil {
+				return err
+			}
+			if it := byID[id]; it != nil {
+				it.Variants = append(it.Variants, v)
+			}
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(context.Background(), `SELECT item_id, label, price, multi
+		FROM modifiers WHERE item_id = ANY($1) ORDER BY item_id, ord`, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var m Modifier
+		if err := rows.Scan(&id, &m.Label, &m.Price, &m.Multi); err != nil {
+			return err
+		}
+		if it := byID[id]; it != nil {
+			it.Modifiers = append(it.Modifiers, m)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return getTranslations(db, byID, ids)
+}
+
+// getTranslations fills in the translations of the items in byID.
+func getTranslations(db util.DB, byID map[int]*Item, ids []int) (err error) {
+	rows, err := db.Query(context.Background(), `SELECT item_id, lang,
+		coalesce(name, ''), coalesce(descr, '')
+		FROM item_translations WHERE item_id = ANY($1)`, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var lang string
+		var t Translation
+		if err := rows.Scan(&id, &lang, &t.Name, &t.Descr); err != nil {
+			return err
+		}
+		if it := byID[id]; it != nil {
+			if it.Translations == nil {
+				it.Translations = make(map[string]Translation)
+			}
+			it.Translations[lang] = t
+		}
+	}
+	return rows.Err()
+}
+
+// SetTranslation sets the translation of the item with the given id into
+// lang, removing it if it is empty.
+func SetTranslation(db util.DB, id int, lang string, t Translation) (err error) {
+	if t == (Translation{}) {
+		_, err = db.Exec(context.Background(),
+			"DELETE FROM item_translations WHERE item_id = $1 AND lang = $2", id, lang)
+		return err
+	}
+	_, err = db.Exec(context.Background(),
+		`INSERT INTO item_translations (item_id, lang, name, descr)
+		VALUES ($1, $2, nullif($3, ''), nullif($4, ''))
+		ON CONFLICT (item_id, lang) DO UPDATE
+		SET name = EXCLUDED.name, descr = EXCLUDED.descr`, id, lang, t.Name, t.Descr)
+	return err
 }
@@ -0,0 +1,701 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/gif"
+	imgpng "image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexurco/gobuffet/util"
+	"github.com/lexurco/gobuffet/util/dbtest"
+)
+
+func TestMatchItems(t *testing.T) {
+	for _, c := range []struct {
+		ids   []int
+		names []string
+		args  []any
+		where string
+		all   []any
+	}{
+		{nil, nil, nil, "TRUE", nil},
+		{[]int{1}, nil, nil, "id = $1", []any{1}},
+		{nil, []string{"Pizza"}, nil, "name = $1", []any{"Pizza"}},
+		{[]int{1, 2}, []string{"Pizza"}, nil,
+			"id = $1 OR id = $2 OR name = $3", []any{1, 2, "Pizza"}},
+		{[]int{3}, nil, []any{"x"}, "id = $2", []any{"x", 3}},
+	} {
+		where, all := matchItems(c.ids, c.names, c.args)
+		if where != c.where || !reflect.DeepEqual(all, c.all) {
+			t.Errorf("matchItems(%v, %v, %v) = %q, %v; want %q, %v",
+				c.ids, c.names, c.args, where, all, c.where, c.all)
+		}
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	for ord, want := range map[Order]string{
+		ByID:        " ORDER BY id",
+		ByName:      " ORDER BY name",
+		ByPrice:     " ORDER BY price, name",
+		ByRelevance: " ORDER BY name",
+	} {
+		if got := orderBy(ord); got != want {
+			t.Errorf("orderBy(%v) = %q, want %q", ord, got, want)
+		}
+	}
+}
+
+func TestGetSQL(t *testing.T) {
+	const sel = "SELECT id, name, descr, price, vat_rate, img, updated_at, " +
+		"sold_out_until, max_qty, slug FROM items WHERE "
+	for _, c := range []struct {
+		ids   []int
+		names []string
+		pr    PriceRange
+		ord   Order
+		sql   string
+		args  []any
+	}{
+		{nil, nil, AnyPrice, ByID, sel + "(TRUE) AND TRUE ORDER BY id", nil},
+		{[]int{7}, []string{"Cola"}, AnyPrice, ByName,
+			sel + "(id = $1 OR name = $2) AND TRUE ORDER BY name", []any{7, "Cola"}},
+		{nil, nil, PriceRange{100, 500}, ByPrice,
+			sel + "(TRUE) AND TRUE AND price >= $1 AND price <= $2 ORDER BY price, name",
+			[]any{100, 500}},
+		{[]int{7}, nil, PriceRange{-1, 500}, ByID,
+			sel + "(id = $1) AND TRUE AND price <= $2 ORDER BY id", []any{7, 500}},
+	} {
+		sql, args := getSQL(c.ids, c.names, c.pr, c.ord)
+		if sql != c.sql || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("getSQL(%v, %v, %v, %v) =\n\t%q, %v\nwant\n\t%q, %v",
+				c.ids, c.names, c.pr, c.ord, sql, args, c.sql, c.args)
+		}
+	}
+}
+
+func TestDel(t *testing.T) {
+	db := &dbtest.DB{}
+	if _, err := Del(db, []int{4}, []string{"Cola"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []dbtest.Stmt{
+		{SQL: "SELECT img FROM items WHERE id = $1 OR name = $2", Args: []any{4, "Cola"}},
+		{SQL: "DELETE FROM items WHERE id = $1 OR name = $2", Args: []any{4, "Cola"}},
+	}
+	if got := db.Stmts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Del ran %v, want %v", got, want)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	db := &dbtest.DB{Rows: func(sql string, args []any) ([][]any, error) {
+		if strings.HasPrefix(sql, "INSERT INTO items") {
+			return [][]any{{9}}, nil
+		}
+		return nil, nil
+	}}
+	name, descr, price, vat := "Pizza", "tasty", 1000, 1800
+	it := Item{Name: &name, Descr: &descr, Price: &price, VAT: &vat}
+	id, err := Add(context.Background(), db, &it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 9 || *it.ID != 9 {
+		t.Errorf("Add returned ID %v, set %v; want 9", id, *it.ID)
+	}
+	stmt, ok := db.Find("INSERT INTO items")
+	if !ok {
+		t.Fatal("no INSERT")
+	}
+	const sql = "INSERT INTO items (name,price,slug,descr,vat_rate) " +
+		"VALUES ($1,$2,$3,$4,$5) RETURNING id"
+	args := []any{&name, &price, "pizza", &descr, 1800}
+	if stmt.SQL != sql || !reflect.DeepEqual(stmt.Args, args) {
+		t.Errorf("Add ran %q, %v; want %q, %v", stmt.SQL, stmt.Args, sql, args)
+	}
+	if _, ok = db.Find("setval"); ok {
+		t.Error("sequence set without an explicit ID")
+	}
+
+	// An explicit ID moves the sequence past it.
+	db.Reset()
+	it = Item{Name: &name, Price: &price, ID: &id}
+	if _, err = Add(context.Background(), db, &it); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = db.Find("pg_get_serial_sequence('items', 'id')"); !ok {
+		t.Errorf("sequence not set after an explicit ID: %q", db.Stmts())
+	}
+}
+
+func TestAddBatchFinish(t *testing.T) {
+	util.ImgDir = t.TempDir()
+	var first string
+	db := &dbtest.DB{Rows: func(sql string, args []any) ([][]any, error) {
+		if !strings.HasPrefix(sql, "INSERT INTO items") {
+			return nil, nil
+		}
+		// The file of the first image goes missing before it is renamed.
+		for _, a := range args {
+			if s, ok := a.(string); ok && strings.HasSuffix(s, ".png") {
+				if first == "" {
+					first = s
+				} else {
+					os.Remove(util.ImgPath(first) + PartSuffix)
+				}
+			}
+		}
+		return [][]any{{9}}, nil
+	}}
+	var items []Item
+	for _, n := range []string{"a", "b"} {
+		name, price, img := n, 100, n+".png"
+		it := Item{Name: &name, Price: &price}
+		it.Img.Name = &img
+		it.Img.Reader = strings.NewReader(n)
+		items = append(items, it)
+	}
+	if err := AddBatch(context.Background(), db, items); err != nil {
+		t.Fatalf("AddBatch = %v, want the committed items kept", err)
+	}
+	ents, _ := os.ReadDir(util.ImgPath(""))
+	if len(ents) != 1 || strings.HasSuffix(ents[0].Name(), PartSuffix) ||
+		ents[0].Name() == first {
+
+		t.Errorf("images left %v, want the second finished", ents)
+	}
+}
+
+// modRows answers the UPDATE of Mod as if the item were there.
+func modRows(sql string, args []any) (rows [][]any, err error) {
+	if strings.HasPrefix(sql, "UPDATE items") {
+		return [][]any{{3, "Pie"}}, nil
+	}
+	return nil, nil
+}
+
+func TestMod(t *testing.T) {
+	db := &dbtest.DB{Rows: modRows}
+	name, price := "Pie", 900
+	err := Mod(context.Background(), db, 3, "", &Item{Name: &name, Price: &price})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, ok := db.Find("UPDATE items")
+	if !ok {
+		t.Fatal("no UPDATE")
+	}
+	const sql = "UPDATE items SET name = $1,price = $2,updated_at = now() " +
+		"WHERE id = $3 RETURNING id, name"
+	args := []any{"Pie", &price, 3}
+	if stmt.SQL != sql || !reflect.DeepEqual(stmt.Args, args) {
+		t.Errorf("Mod ran %q, %v; want %q, %v", stmt.SQL, stmt.Args, sql, args)
+	}
+
+	db.Reset()
+	err = Mod(context.Background(), db, -1, "Pie", &Item{Price: &price})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, _ = db.Find("UPDATE items")
+	if want := []any{&price, "Pie"}; !reflect.DeepEqual(stmt.Args, want) {
+		t.Errorf("Mod by name ran %q, %v; want args %v", stmt.SQL, stmt.Args, want)
+	}
+
+	if _, ok = db.Find("setval"); ok {
+		t.Error("sequence set without a new ID")
+	}
+
+	// A new ID moves the sequence past it.
+	db.Reset()
+	id := 40
+	if err = Mod(context.Background(), db, 3, "", &Item{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = db.Find("pg_get_serial_sequence('items', 'id')"); !ok {
+		t.Errorf("sequence not set after a new ID: %q", db.Stmts())
+	}
+
+	err = Mod(context.Background(), &dbtest.DB{}, 4, "", &Item{Price: &price})
+	if !errors.Is(err, ErrNoItem) {
+		t.Errorf("Mod of a missing item = %v, want %v", err, ErrNoItem)
+	}
+}
+
+func TestModImg(t *testing.T) {
+	util.ImgDir = t.TempDir()
+	if err := os.WriteFile(util.ImgPath("old.png"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db := &dbtest.DB{Rows: func(sql string, args []any) ([][]any, error) {
+		if strings.HasPrefix(sql, "SELECT img FROM items") {
+			old := "old.png"
+			return [][]any{{&old}}, nil
+		}
+		return modRows(sql, args)
+	}}
+
+	var it Item
+	name := "new.png"
+	it.Img.Name = &name
+	it.Img.Reader = strings.NewReader("new")
+	if err := Mod(context.Background(), db, 3, "", &it); err != nil {
+		t.Fatal(err)
+	}
+	stmt, _ := db.Find("SELECT img")
+	want := dbtest.Stmt{SQL: "SELECT img FROM items WHERE id = $1", Args: []any{3}}
+	if !reflect.DeepEqual(stmt, want) {
+		t.Errorf("Mod ran %v, want %v", stmt, want)
+	}
+	stmt, _ = db.Find("UPDATE items")
+	img, _ := stmt.Args[0].(string)
+	if _, err := os.Stat(util.ImgPath(img)); img == "" || err != nil {
+		t.Errorf("new image %q not in place: %v", img, err)
+	}
+	if _, err := os.Stat(util.ImgPath("old.png")); !os.IsNotExist(err) {
+		t.Errorf("old image not removed: %v", err)
+	}
+
+	db.Reset()
+	none := ""
+	it = Item{}
+	it.Img.Name = &none
+	if err := Mod(context.Background(), db, -1, "Pie", &it); err != nil {
+		t.Fatal(err)
+	}
+	stmt, _ = db.Find("UPDATE items")
+	const sql = "UPDATE items SET img = $1,updated_at = now() WHERE name = $2 " +
+		"RETURNING id, name"
+	if args := []any{nil, "Pie"}; stmt.SQL != sql || !reflect.DeepEqual(stmt.Args, args) {
+		t.Errorf("Mod ran %q, %v; want %q, %v", stmt.SQL, stmt.Args, sql, args)
+	}
+
+	// The image of a missing item is not left behind.
+	util.ImgDir = t.TempDir()
+	it = Item{}
+	it.Img.Name = &name
+	it.Img.Reader = strings.NewReader("new")
+	err := Mod(context.Background(), &dbtest.DB{}, 4, "", &it)
+	if !errors.Is(err, ErrNoItem) {
+		t.Errorf("Mod of a missing item = %v, want %v", err, ErrNoItem)
+	}
+	if ents, _ := os.ReadDir(util.ImgPath("")); len(ents) > 0 {
+		t.Errorf("image of a missing item left: %v", ents[0].Name())
+	}
+}
+
+func TestParseItem(t *testing.T) {
+	for _, c := range []struct {
+		item string
+		id   int
+		name string
+		err  bool
+	}{
+		{"12", 12, "", false},
+		{"id:12", 12, "", false},
+		{"name:12", -1, "12", false},
+		{"name:007", -1, "007", false},
+		{"Pizza", -1, "Pizza", false},
+		{"name:Pizza", -1, "Pizza", false},
+		{"name:id:3", -1, "id:3", false},
+		{"Pizza: large", -1, "Pizza: large", false},
+		{"-5", -1, "-5", false},
+		{"id:x", -1, "", true},
+		{"id:-1", -1, "", true},
+		{"99999999999999999999", -1, "", true},
+	} {
+		id, name, err := ParseItem(c.item)
+		if id != c.id || name != c.name || (err != nil) != c.err {
+			t.Errorf("ParseItem(%q) = %v, %q, %v; want %v, %q, error %v",
+				c.item, id, name, err, c.id, c.name, c.err)
+		}
+	}
+}
+
+func TestHEICLimits(t *testing.T) {
+	util.ImgDir = t.TempDir()
+	defer func(cmd string, lim ImgLimits) {
+		HEICConverter, HEICLimits = cmd, lim
+	}(HEICConverter, HEICLimits)
+
+	// The "converter" gives a PNG of 100x60 whatever it is given.
+	png := t.TempDir() + "/converted.png"
+	f, err := os.Create(png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = imgpng.Encode(f, image.NewGray(image.Rect(0, 0, 100, 60))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	t.Setenv("TEST_PNG", png)
+	HEICConverter = `cp "$TEST_PNG" "$2"`
+
+	heic := append([]byte("\x00\x00\x00\x18ftypheic"), make([]byte, 100)...)
+	for _, c := range []struct {
+		lim ImgLimits
+		ok  bool
+	}{
+		{ImgLimits{}, true},
+		{ImgLimits{Width: 100, Height: 60}, true},
+		{ImgLimits{Width: 99}, false},
+		{ImgLimits{Height: 59}, false},
+		{ImgLimits{Pixels: 5999}, false},
+	} {
+		HEICLimits = c.lim
+		img, err := copyImg(context.Background(), "", "a.HEIC", bytes.NewReader(heic))
+		var imgErr *ImgError
+		switch {
+		case c.ok && err != nil:
+			t.Errorf("%+v: %v", c.lim, err)
+		case !c.ok && !errors.As(err, &imgErr):
+			t.Errorf("%+v: error %v, want an ImgError", c.lim, err)
+		case !c.ok:
+			if ents, _ := os.ReadDir(util.ImgDir); len(ents) > 0 {
+				t.Errorf("%+v: %v left behind", c.lim, ents[0].Name())
+			}
+		default:
+			dropImg(img)
+		}
+	}
+}
+
+func TestCheckImgFormats(t *testing.T) {
+	le := binary.LittleEndian
+	webp := func(chunk string, payload []byte) []byte {
+		b := []byte("RIFF\x00\x00\x00\x00WEBP" + chunk + "\x00\x00\x00\x00")
+		return append(b, append(payload, make([]byte, 16)...)...)
+	}
+	vp8 := []byte("\x00\x00\x00\x9d\x01\x2a")
+	vp8 = le.AppendUint16(le.AppendUint16(vp8, 640), 480)
+	vp8l := le.AppendUint32([]byte{0x2f}, 639|479<<14)
+	vp8x := []byte{0, 0, 0, 0, 0x7f, 0x02, 0, 0xdf, 0x01, 0}
+
+	bmp := []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	bmp = le.AppendUint32(bmp, 40)
+	bmp = le.AppendUint32(le.AppendUint32(bmp, 640), uint32(0xffffffff-480+1))
+
+	var pngBuf bytes.Buffer
+	if err := imgpng.Encode(&pngBuf, image.NewGray(image.Rect(0, 0, 640, 480))); err != nil {
+		t.Fatal(err)
+	}
+	ico := func(w, h byte, data []byte) []byte {
+		b := []byte{0, 0, 1, 0, 1, 0, w, h, 0, 0, 1, 0, 32, 0}
+		b = le.AppendUint32(b, uint32(len(data)))
+		return append(le.AppendUint32(b, 22), data...)
+	}
+
+	lim := ImgLimits{Width: 640, Height: 480}
+	small := ImgLimits{Width: 639}
+	for _, c := range []struct {
+		name string
+		img  []byte
+		ok   bool
+	}{
+		{"vp8", webp("VP8 ", vp8), true},
+		{"vp8l", webp("VP8L", vp8l), true},
+		{"vp8x", webp("VP8X", vp8x), true},
+		{"bmp", append(bmp, make([]byte, 16)...), true},
+		{"ico png", ico(0, 0, pngBuf.Bytes()), true},
+		{"ico bmp", ico(32, 32, make([]byte, 64)), true},
+		{"garbage", []byte("not an image at all, really"), false},
+		{"truncated webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), false},
+	} {
+		err := CheckImg(bytes.NewReader(c.img), lim)
+		if c.ok != (err == nil) {
+			t.Errorf("%v: %v", c.name, err)
+		}
+		if c.ok && c.name != "ico bmp" {
+			if err = CheckImg(bytes.NewReader(c.img), small); err == nil {
+				t.Errorf("%v: limit %+v not enforced", c.name, small)
+			}
+		}
+	}
+}
+
+func TestFetchImg(t *testing.T) {
+	var pngBuf bytes.Buffer
+	if err := imgpng.Encode(&pngBuf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngBuf.Bytes())
+		case "/slow.png":
+			<-hang
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	// The test server is on loopback, which is refused.
+	if _, _, err := FetchImg(context.Background(), ts.URL+"/a.png"); err == nil ||
+		!strings.Contains(err.Error(), "non-public address") {
+
+		t.Errorf("fetching from loopback: %v", err)
+	}
+
+	defer func(f func(string) error) { checkFetchAddr = f }(checkFetchAddr)
+	checkFetchAddr = func(string) error { return nil }
+
+	name, _, err := FetchImg(context.Background(), ts.URL+"/a.png")
+	if err != nil || name != "a.png" {
+		t.Errorf("got %q, %v; want a.png", name, err)
+	}
+	if _, _, err = FetchImg(context.Background(), ts.URL+"/none"); err == nil {
+		t.Error("fetched a 404")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err = FetchImg(ctx, ts.URL+"/slow.png"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow fetch: %v, want the deadline exceeded", err)
+	}
+}
+
+func TestCheckFetchAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"93.184.215.14:80", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.0.1:443", false},
+		{"172.16.0.1:443", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[fd00::1]:80", false},
+	} {
+		if err := checkFetchAddr(c.addr); c.ok != (err == nil) {
+			t.Errorf("%v: %v", c.addr, err)
+		}
+	}
+}
+
+func TestConvertImgs(t *testing.T) {
+	util.ImgDir = t.TempDir()
+	defer func(c map[string]string) { ImgConverters = c }(ImgConverters)
+	ImgConverters = map[string]string{"webp": `cp "$1" "$2"`, "avif": "false"}
+
+	for _, f := range []string{"a.jpg", "b.png", "b.png.webp", "c.webp",
+		".lock", "d.jpg.part", "notes.txt"} {
+
+		if err := os.WriteFile(util.ImgPath(f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	converted, err := ConvertImgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The failing avif converter leaves nothing behind, and b.png has its
+	// webp already.
+	if want := []string{"a.jpg", "c.webp"}; !reflect.DeepEqual(converted, want) {
+		t.Errorf("converted %q, want %q", converted, want)
+	}
+	ents, _ := os.ReadDir(util.ImgDir)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	want := []string{".lock", "a.jpg", "a.jpg.webp", "b.png", "b.png.webp",
+		"c.webp", "c.webp.webp", "d.jpg.part", "notes.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files %q, want %q", names, want)
+	}
+}
+
+func TestCurFlags(t *testing.T) {
+	defer func(c Currency) { Cur = c }(Cur)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	CurFlags(fs)
+	err := fs.Parse([]string{"-currency", "JPY", "-symbol", "¥", "-symbolbefore", "-minor", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Currency{Code: "JPY", Symbol: "¥", Before: true}); Cur != want {
+		t.Errorf("Cur = %+v, want %+v", Cur, want)
+	}
+	var p Price
+	if err = p.Set("1200"); err != nil || p != 1200 {
+		t.Errorf("price 1200 in yen = %v, %v", p, err)
+	}
+	if err = p.Set("12.50"); err == nil {
+		t.Errorf("price 12.50 in yen = %v", p)
+	}
+}
+
+func TestOptFlags(t *testing.T) {
+	var price, unset OptPrice
+	var rate OptRate
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&price, "price", "")
+	fs.Var(&unset, "unset", "")
+	fs.Var(&rate, "vat", "")
+	var b bytes.Buffer
+	fs.SetOutput(&b)
+	fs.PrintDefaults()
+	if strings.Contains(b.String(), "default") {
+		t.Errorf("defaults shown for unset flags:\n%v", b.String())
+	}
+
+	if err := fs.Parse([]string{"-price", "0", "-vat", "7.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if price != (OptPrice{0, true}) {
+		t.Errorf("-price 0 = %+v", price)
+	}
+	if unset.Given {
+		t.Errorf("-unset = %+v, not given", unset)
+	}
+	if rate != (OptRate{7_50, true}) {
+		t.Errorf("-vat 7.5 = %+v", rate)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	img := t.TempDir() + "/pizza.jpg"
+	if err := os.WriteFile(img, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := "name,price,descr,vat,maxqty,img\n" +
+		`Pizza,12.50,"Tomato, cheese",18,3,` + img + "\n" +
+		"Cola,2.50,,,,\n"
+	items, errs := ReadCSV(strings.NewReader(good))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(items) != 2 || *items[0].Name != "Pizza" || *items[0].Price != 1250 ||
+		*items[0].Descr != "Tomato, cheese" || *items[0].VAT != 1800 ||
+		*items[0].MaxQty != 3 || *items[0].Img.Name != img ||
+		*items[1].Name != "Cola" || items[1].Descr != nil || items[1].Img.Name != nil {
+
+		t.Errorf("read %+v", items)
+	}
+
+	// All the errors are reported, not only the first.
+	bad := "price,name,img\n" +
+		"12.5.0,Pizza,\n" +
+		",,\n" +
+		"3,pizza," + img + ".missing\n" +
+		"4,Notes,notes.txt\n"
+	items, errs = ReadCSV(strings.NewReader(bad))
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"line 2: price: invalid price",
+		"line 3: name: required",
+		"line 3: price: required",
+		"line 4: name: pizza also on line 2",
+		"line 4: img: stat " + img + ".missing: no such file or directory",
+		"line 5: img: stat notes.txt: no such file or directory",
+	}
+	if items != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, errors\n%q, want\n%q", items, got, want)
+	}
+
+	for _, head := range []string{"name,cost\n", "descr\n", ""} {
+		if _, errs = ReadCSV(strings.NewReader(head)); len(errs) != 1 {
+			t.Errorf("header %q: %q, want one error", head, errs)
+		}
+	}
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White})
+	}
+	var one, two bytes.Buffer
+	if err := gif.Encode(&one, frame(), nil); err != nil {
+		t.Fatal(err)
+	}
+	err := gif.EncodeAll(&two, &gif.GIF{
+		Image: []*image.Paletted{frame(), frame()},
+		Delay: []int{10, 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		gif  []byte
+		anim bool
+		ok   bool
+	}{
+		{"one frame", one.Bytes(), false, true},
+		{"two frames", two.Bytes(), true, true},
+		// The second frame is found before the truncation.
+		{"two frames truncated", two.Bytes()[:two.Len()-2], true, true},
+		{"one frame truncated", one.Bytes()[:one.Len()-4], false, false},
+		{"no frames", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), false, true},
+		{"garbage", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00junk"), false, false},
+	} {
+		r := bytes.NewReader(c.gif)
+		anim, err := IsAnimated(r)
+		if anim != c.anim || c.ok != (err == nil) {
+			t.Errorf("%v: %v, %v; want %v", c.name, anim, err, c.anim)
+		}
+		if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+			t.Errorf("%v: not rewound", c.name)
+		}
+	}
+}
+
+func TestIcoAlias(t *testing.T) {
+	ico := []byte{0, 0, 1, 0, 1, 0, 16, 16, 0, 0, 1, 0, 32, 0, 64, 0, 0, 0, 22, 0, 0, 0}
+	ico = append(ico, make([]byte, 64)...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/vnd.microsoft.icon")
+		w.Write(ico)
+	}))
+	defer ts.Close()
+	defer func(f func(string) error) { checkFetchAddr = f }(checkFetchAddr)
+	checkFetchAddr = func(string) error { return nil }
+
+	name, _, err := FetchImg(context.Background(), ts.URL+"/favicon")
+	if err != nil || name != "favicon.ico" {
+		t.Errorf("got %q, %v; want favicon.ico", name, err)
+	}
+	if ext := ImgExt("image/vnd.microsoft.icon"); ext != ".ico" {
+		t.Errorf("extension %q, want .ico", ext)
+	}
+}
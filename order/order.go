@@ -0,0 +1,142 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package order
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	iutil "github.com/lexurco/gobuffet/item/util"
+	outil "github.com/lexurco/gobuffet/order/util"
+	tutil "github.com/lexurco/gobuffet/tg/util"
+	"github.com/lexurco/gobuffet/util"
+)
+
+var (
+	flags  = flag.NewFlagSet(os.Args[0]+" order", flag.ExitOnError)
+	dbFlag = flags.String("db", "",
+		"database connection string or URI (environment is used if empty)")
+	configFlag = flags.String("config", "",
+		"JSON file of serve flags, of which those of order are used")
+
+	summaryFlags     = flag.NewFlagSet(os.Args[0]+" order summary", flag.ExitOnError)
+	dateSummaryFlag  = summaryFlags.String("date", "", "day to summarize as YYYY-MM-DD (today if empty)")
+	jsonSummaryFlag  = summaryFlags.Bool("json", false, "print JSON instead of a table")
+	topSummaryFlag   = summaryFlags.Int("top", 5, "number of top items to show")
+	tokenSummaryFlag = summaryFlags.String("token", "",
+		"file containing the telegram bot API token; if given, send the summary")
+	tokenEnvSummaryFlag = summaryFlags.String("tokenenv", "",
+		"environment variable containing the telegram bot API token (instead of -token)")
+	chatSummaryFlag = summaryFlags.Int("chat", math.MaxInt, "telegram chat ID")
+)
+
+func init() {
+	iutil.CurFlags(flags)
+}
+
+func printSummary(w io.Writer, s *outil.Summary) {
+	fmt.Fprintf(w, "Date:     %v\n", s.Date)
+	fmt.Fprintf(w, "Orders:   %v\n", s.Orders)
+	fmt.Fprintf(w, "Revenue:  %v\n", iutil.Cur.Format(s.Revenue))
+	fmt.Fprintf(w, "Delivery: %v\n", iutil.Cur.Format(s.Delivery))
+	if len(s.Top) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%5v %15v %10v\n", "NUM", "NAME", "REVENUE")
+	for _, t := range s.Top {
+		fmt.Fprintf(w, "%5v %15v %10v\n", t.Num, t.Name, iutil.Cur.String(t.Revenue))
+	}
+}
+
+func cmdSummary(args []string) {
+	var buf bytes.Buffer
+
+	summaryFlags.Parse(args[1:])
+	if len(summaryFlags.Args()) != 0 {
+		util.Die("usage: " + os.Args[0] + " order summary [flags ...]")
+	}
+
+	day := time.Now()
+	if *dateSummaryFlag != "" {
+		var err error
+		day, err = time.ParseInLocation(time.DateOnly, *dateSummaryFlag, time.Local)
+		if err != nil {
+			util.Die("invalid date " + *dateSummaryFlag)
+		}
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	s, err := outil.Summarize(db, day, *topSummaryFlag)
+	if err != nil {
+		util.Die(err)
+	}
+
+	if *jsonSummaryFlag {
+		if err = json.NewEncoder(&buf).Encode(s); err != nil {
+			util.Die(err)
+		}
+	} else {
+		printSummary(&buf, &s)
+	}
+	os.Stdout.Write(buf.Bytes())
+
+	if *tokenSummaryFlag != "" || *tokenEnvSummaryFlag != "" {
+		if *chatSummaryFlag == math.MaxInt {
+			util.Die("please provide the chat id")
+		}
+		conf, err := tutil.LoadConf(*tokenSummaryFlag, *tokenEnvSummaryFlag, *chatSummaryFlag)
+		if err != nil {
+			util.Die(err)
+		}
+		if err = tutil.Send(conf, buf.String()); err != nil {
+			util.Die(err)
+		}
+	}
+}
+
+func Order(args []string) {
+	flags.Parse(args[1:])
+	if args = flags.Args(); len(args) < 1 {
+		util.Die("usage: " + os.Args[0] + " order [flags ...] command")
+	}
+	if err := util.LoadEnv(flags); err != nil {
+		util.Die(err)
+	}
+	if *configFlag != "" {
+		if err := util.LoadSharedConfig(flags, *configFlag); err != nil {
+			util.Die(*configFlag + ": " + err.Error())
+		}
+	}
+
+	switch args[0] {
+	case "summary":
+		cmdSummary(args)
+	default:
+		util.Die("unknown subcommand: " + args[0] + "\n" +
+			"available subcommands: summary")
+	}
+}
@@ -0,0 +1,251 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package util
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/lexurco/gobuffet/util"
+)
+
+var (
+	ErrNoOrder  = errors.New("no such order")
+	ErrCanceled = errors.New("order already canceled")
+	ErrTooLate  = errors.New("order too old to cancel")
+	ErrDecided  = errors.New("order already accepted or rejected")
+)
+
+// The statuses the shop may give an order.
+const (
+	Accepted = "accepted"
+	Rejected = "rejected"
+)
+
+// Line is an ordered item.  The item's name and price are copied, so that
+// the order stays intact when the item changes.
+type Line struct {
+	ItemID    int      `json:"item_id"`
+	Name      string   `json:"name"`
+	Variant   string   `json:"variant,omitempty"`
+	Modifiers []string `json:"modifiers,omitempty"`
+	Price     int      `json:"price"` // unit price, including modifiers
+	Num       int      `json:"num"`
+	VAT       int      `json:"vat"` // of the line, included in Price * Num
+}
+
+type Order struct {
+	ID       int       `json:"id"`
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`
+	Contact  string    `json:"contact"`
+	Address  string    `json:"address"`
+	Comments string    `json:"comments,omitempty"`
+	Delivery int       `json:"delivery"`
+	Tip      int       `json:"tip"`
+	VAT      int       `json:"vat"`   // included in Total
+	Total    int       `json:"total"` // including delivery and tip
+	Lines    []Line    `json:"lines"`
+}
+
+// Add stores o, setting its ID and Time.
+func Add(db util.DB, o *Order) (err error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	err = tx.QueryRow(context.Background(),
+		`INSERT INTO orders
+		(name, contact, address, comments, delivery, tip, vat, total)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		o.Name, o.Contact, o.Address, o.Comments, o.Delivery, o.Tip, o.VAT, o.Total).
+		Scan(&o.ID, &o.Time)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range o.Lines {
+		_, err = tx.Exec(context.Background(),
+			`INSERT INTO order_items
+			(order_id, item_id, name, variant, modifiers, price, num, vat)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			o.ID, l.ItemID, l.Name, l.Variant, l.Modifiers, l.Price, l.Num, l.VAT)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Cancel cancels the order with the given id placed with contact, if it was
+// placed no earlier than since.  It returns the order without its lines.
+// A wrong contact is reported as ErrNoOrder, so as not to tell of orders
+// to whoever guesses their IDs.
+func Cancel(db util.DB, id int, contact string, since time.Time) (o Order, err error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return o, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var canceled *time.Time
+	var comments *string
+	err = tx.QueryRow(context.Background(),
+		`SELECT id, created_at, name, contact, address, comments, delivery,
+		total, canceled_at FROM orders WHERE id = $1 FOR UPDATE`, id).
+		Scan(&o.ID, &o.Time, &o.Name, &o.Contact, &o.Address, &comments,
+			&o.Delivery, &o.Total, &canceled)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && o.Contact != contact) {
+		return Order{}, ErrNoOrder
+	} else if err != nil {
+		return o, err
+	}
+	if comments != nil {
+		o.Comments = *comments
+	}
+	if canceled != nil {
+		return o, ErrCanceled
+	}
+	if o.Time.Before(since) {
+		return o, ErrTooLate
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE orders SET canceled_at = now() WHERE id = $1", id)
+	if err != nil {
+		return o, err
+	}
+	return o, tx.Commit(context.Background())
+}
+
+// SetStatus gives the order with the given id status, Accepted or Rejected,
+// unless it was canceled or given one already.
+func SetStatus(db util.DB, id int, status string) (err error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var canceled *time.Time
+	var cur *string
+	err = tx.QueryRow(context.Background(),
+		"SELECT canceled_at, status FROM orders WHERE id = $1 FOR UPDATE", id).
+		Scan(&canceled, &cur)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNoOrder
+	} else if err != nil {
+		return err
+	}
+	if canceled != nil {
+		return ErrCanceled
+	}
+	if cur != nil {
+		return ErrDecided
+	}
+
+	_, err = tx.Exec(context.Background(),
+		"UPDATE orders SET status = $2 WHERE id = $1", id, status)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+type TopItem struct {
+	Name    string `json:"name"`
+	Num     int    `json:"num"`
+	Revenue int    `json:"revenue"`
+}
+
+type Summary struct {
+	Date     string    `json:"date"`
+	Orders   int       `json:"orders"`
+	Revenue  int       `json:"revenue"`
+	Delivery int       `json:"delivery"`
+	Top      []TopItem `json:"top"`
+}
+
+// Summarize aggregates the orders placed on the day of t, in the location
+// of t, leaving out canceled ones.  At most ntop items are listed in Top.
+func Summarize(db util.DB, t time.Time, ntop int) (s Summary, err error) {
+	from := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	to := from.AddDate(0, 0, 1)
+	s.Date = from.Format(time.DateOnly)
+
+	err = db.QueryRow(context.Background(),
+		`SELECT count(*), coalesce(sum(total), 0), coalesce(sum(delivery), 0)
+		FROM orders WHERE created_at >= $1 AND created_at < $2
+		AND canceled_at IS NULL`, from, to).
+		Scan(&s.Orders, &s.Revenue, &s.Delivery)
+	if err != nil {
+		return s, err
+	}
+
+	rows, err := db.Query(context.Background(),
+		`SELECT i.name, sum(i.num), sum(i.num * i.price)
+		FROM order_items i JOIN orders o ON o.id = i.order_id
+		WHERE o.created_at >= $1 AND o.created_at < $2
+		AND o.canceled_at IS NULL
+		GROUP BY i.name ORDER BY 2 DESC, 1 LIMIT $3`, from, to, ntop)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ti TopItem
+		if err := rows.Scan(&ti.Name, &ti.Num, &ti.Revenue); err != nil {
+			return s, err
+		}
+		s.Top = append(s.Top, ti)
+	}
+	return s, rows.Err()
+}
+
+// Popular returns the ids of at most n items, those ordered most since t,
+// leaving out canceled orders, the items sold out now and those of except.
+func Popular(db util.DB, t time.Time, n int, except []int) (ids []int, err error) {
+	if except == nil {
+		except = []int{}
+	}
+	rows, err := db.Query(context.Background(),
+		`SELECT i.item_id
+		FROM order_items i JOIN orders o ON o.id = i.order_id
+		JOIN items it ON it.id = i.item_id
+		WHERE o.created_at >= $1 AND o.canceled_at IS NULL
+		AND NOT i.item_id = ANY($2)
+		AND (it.sold_out_until IS NULL OR it.sold_out_until <= now())
+		GROUP BY i.item_id ORDER BY sum(i.num) DESC, 1 LIMIT $3`, t, except, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -15,13 +15,17 @@
 package pw
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"context"
 	"flag"
+	"io"
 	"os"
 	"syscall"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
 
 	putil "github.com/lexurco/gobuffet/pw/util"
@@ -30,6 +34,10 @@ import (
 
 var flags = flag.NewFlagSet(os.Args[0] + " pw", flag.ExitOnError)
 var dbFlag = flags.String("db", "", "database connection string or URI")
+var userFlag = flags.String("user", "admin", "user whose password to set")
+var costFlag = flags.Int("bcryptcost", bcrypt.DefaultCost, "bcrypt cost of the password hash")
+var configFlag = flags.String("config", "",
+	"JSON file of serve flags, of which those of pw are used")
 
 func pwGet() (pass []byte, err error) {
 	if !term.IsTerminal(syscall.Stdin) {
@@ -47,12 +55,120 @@ func pwGet() (pass []byte, err error) {
 	return pass, err
 }
 
+// check tells whether a password, read from the terminal or else from
+// the standard input, is that of the user, admin by default.
+func check(args []string) {
+	user := "admin"
+	switch len(args) {
+	case 1:
+	case 2:
+		user = args[1]
+	default:
+		util.Die("usage: " + os.Args[0] + " pw [options ...] check [user]")
+	}
+
+	var pass []byte
+	var err error
+	if term.IsTerminal(syscall.Stdin) {
+		pass, err = pwGet()
+	} else {
+		pass, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err == io.EOF {
+			err = nil
+		}
+		pass = bytes.TrimRight(pass, "\r\n")
+	}
+	if err != nil {
+		util.Die(err)
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	ok, err := putil.Check(db, user, pass)
+	if err != nil {
+		util.Die(err)
+	}
+	if !ok {
+		util.Die("password does not match")
+	}
+	fmt.Println("password matches")
+}
+
+// list prints the names of the users, one per line.
+func list(args []string) {
+	if len(args) != 1 {
+		util.Die("usage: " + os.Args[0] + " pw [options ...] list")
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	names, err := putil.List(db)
+	if err != nil {
+		util.Die(err)
+	}
+	for _, n := range names {
+		fmt.Println(n)
+	}
+}
+
+// del deletes the user given in args.
+func del(args []string) {
+	if len(args) != 2 {
+		util.Die("usage: " + os.Args[0] + " pw [options ...] del user")
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+	defer db.Close(context.Background())
+
+	if err = putil.DelUser(db, args[1]); err != nil {
+		util.Die(args[1] + ": " + err.Error())
+	}
+}
+
 func Pw(args []string) {
 	var pass []byte
 	var err error
 
 	flags.Parse(args[1:])
 	args = flags.Args()
+	if err := util.LoadEnv(flags); err != nil {
+		util.Die(err)
+	}
+	if *configFlag != "" {
+		if err := util.LoadSharedConfig(flags, *configFlag); err != nil {
+			util.Die(*configFlag + ": " + err.Error())
+		}
+	}
+	if *costFlag < bcrypt.MinCost || *costFlag > bcrypt.MaxCost {
+		util.Die(fmt.Sprintf("-bcryptcost must be from %v to %v",
+			bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	putil.Cost = *costFlag
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "check":
+			check(args)
+			return
+		case "list":
+			list(args)
+			return
+		case "del":
+			del(args)
+			return
+		}
+	}
 
 	switch len(args) {
 	case 0:
@@ -60,7 +176,7 @@ func Pw(args []string) {
 	case 1:
 		pass = []byte(args[0])
 	default:
-		util.Die("usage: " + os.Args[0] + " pw [options ...] [password]")
+		util.Die("usage: " + os.Args[0] + " pw [options ...] [password | check [user] | list | del user]")
 	}
 
 	db, err := util.DBConnect(*dbFlag)
@@ -74,7 +190,13 @@ func Pw(args []string) {
 			util.Die(err)
 		}
 	}
-	if err := putil.Chpass(db, pass); err != nil {
+	created, err := putil.ChpassUser(db, *userFlag, pass)
+	if err != nil {
 		util.Die(err)
 	}
+	if created {
+		fmt.Println("created user " + *userFlag)
+	} else {
+		fmt.Println("updated password for " + *userFlag)
+	}
 }
@@ -16,28 +16,131 @@ package util
 
 import (
 	"context"
+	"errors"
 
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/lexurco/gobuffet/util"
 )
 
-func Chpass(db *pgx.Conn, pass []byte) (err error) {
-	hash, err := bcrypt.GenerateFromPassword(pass, bcrypt.DefaultCost)
-	for i := range pass {
-		pass[i] = 0
+// Cost is the bcrypt cost of new password hashes.
+var Cost = bcrypt.DefaultCost
+
+// Check reports whether pass is the password of user.
+func Check(db util.DB, user string, pass []byte) (ok bool, err error) {
+	var hash []byte
+	err = db.QueryRow(context.Background(),
+		"SELECT pass FROM passwd WHERE name = $1", user).Scan(&hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, errors.New("no such user: " + user)
+	} else if err != nil {
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword(hash, pass)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List returns the names of the users, sorted.
+func List(db util.DB) (names []string, err error) {
+	rows, err := db.Query(context.Background(), "SELECT name FROM passwd ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
 	}
+	return names, rows.Err()
+}
+
+var (
+	ErrNoUser   = errors.New("no such user")
+	ErrLastUser = errors.New("can't delete the last user")
+)
+
+// DelUser deletes the user name, unless it is the last one, so that there
+// is always someone to log in as.
+func DelUser(db util.DB, name string) (err error) {
+	tx, err := db.Begin(context.Background())
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(context.Background())
 
-	_, err = db.Exec(context.Background(),
-		`INSERT INTO passwd (name, pass)
-		VALUES ('admin', $1) ON CONFLICT (name) DO UPDATE
-		SET pass = EXCLUDED.pass`, hash)
+	// Lest two deletions at once leave nobody.
+	_, err = tx.Exec(context.Background(), "LOCK TABLE passwd IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+	var n int
+	err = tx.QueryRow(context.Background(), "SELECT count(*) FROM passwd").Scan(&n)
 	if err != nil {
 		return err
 	}
+	tag, err := tx.Exec(context.Background(), "DELETE FROM passwd WHERE name = $1", name)
+	switch {
+	case err != nil:
+		return err
+	case tag.RowsAffected() == 0:
+		return ErrNoUser
+	case n <= 1:
+		return ErrLastUser
+	}
+	return tx.Commit(context.Background())
+}
+
+// Upgrade hashes pass anew at Cost if hash, its stored hash for user, has
+// a lower cost, and tells whether it did.  A hash changed meanwhile is left
+// as it is.
+func Upgrade(db util.DB, user string, pass, hash []byte) (ok bool, err error) {
+	cost, err := bcrypt.Cost(hash)
+	if err != nil || cost >= Cost {
+		return false, err
+	}
+	newHash, err := bcrypt.GenerateFromPassword(pass, Cost)
+	if err != nil {
+		return false, err
+	}
+	tag, err := db.Exec(context.Background(),
+		"UPDATE passwd SET pass = $1 WHERE name = $2 AND pass = $3",
+		newHash, user, hash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Chpass sets the password of admin, as ChpassUser does.
+func Chpass(db util.DB, pass []byte) (created bool, err error) {
+	return ChpassUser(db, "admin", pass)
+}
+
+// ChpassUser sets the password of user, creating the user if there is no
+// such, and tells whether it did.  The password is zeroed.
+func ChpassUser(db util.DB, user string, pass []byte) (created bool, err error) {
+	hash, err := bcrypt.GenerateFromPassword(pass, Cost)
+	for i := range pass {
+		pass[i] = 0
+	}
+	if err != nil {
+		return false, err
+	}
 
-	return nil
+	// xmax is 0 for rows just inserted, and not for those updated.
+	err = db.QueryRow(context.Background(),
+		`INSERT INTO passwd (name, pass)
+		VALUES ($1, $2) ON CONFLICT (name) DO UPDATE
+		SET pass = EXCLUDED.pass
+		RETURNING xmax = 0`, user, hash).Scan(&created)
+	return created, err
 }
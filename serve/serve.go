@@ -16,54 +16,106 @@ package serve
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	htemplate "html/template"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"math"
 	"mime"
 	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/jackc/pgx/v5"
 
 	iutil "github.com/lexurco/gobuffet/item/util"
+	outil "github.com/lexurco/gobuffet/order/util"
 	putil "github.com/lexurco/gobuffet/pw/util"
+	sutil "github.com/lexurco/gobuffet/setting/util"
 	tutil "github.com/lexurco/gobuffet/tg/util"
 	"github.com/lexurco/gobuffet/util"
 )
 
+// price is an amount in minor units, also shown with (Str) and without
+// (Val) the currency symbol.
 type price struct {
-	Num int
-	Str string
+	Num int    `json:"num"`
+	Str string `json:"str"`
+	Val string `json:"-"`
+}
+
+func (srv *Server) newPrice(n int) (p price) {
+	return price{Num: n, Str: srv.cur.Format(n), Val: srv.cur.String(n)}
+}
+
+type variant struct {
+	Label string `json:"label"`
+	Price price  `json:"price"`
+}
+
+type modifier struct {
+	Label string `json:"label"`
+	Price price  `json:"price"`
+	Multi bool   `json:"multi"`
 }
 
 type item struct {
-	ID    int
-	Ord   int
-	Name  string
-	Descr string
-	Price price
-	Img   string
+	ID        int        `json:"id"`
+	Ord       int        `json:"-"`
+	Name      string     `json:"name"`
+	Descr     string     `json:"descr,omitempty"`
+	Price     price      `json:"price"`
+	VAT       int        `json:"vat"` // rate in hundredths of a percent
+	Img       string     `json:"img,omitempty"`
+	Variants  []variant  `json:"variants,omitempty"`
+	Modifiers []modifier `json:"modifiers,omitempty"`
+	Updated   time.Time  `json:"updated"`
+	SoldOut   bool       `json:"sold_out"`
+	MaxQty    int        `json:"max_qty"` // most one may order
+	Slug      string     `json:"-"`       // for /item/{slug}
+
+	Num     int      `json:"-"`
+	Variant string   `json:"-"`
+	Chosen  []string `json:"-"` // labels of the chosen modifiers
+	Total   price    `json:"-"`
+	VATAmt  price    `json:"-"` // included in Total
 
-	Num   int
-	Total price
+	Errors fieldErrors `json:"-"` // of the last modification
+
+	SoldOutUntil time.Time                    `json:"-"`
+	OwnMaxQty    int                          `json:"-"` // 0 for -itemqty
+	Translations map[string]iutil.Translation `json:"translations,omitempty"`
 }
 
 var (
@@ -71,33 +123,601 @@ var (
 
 	flags     = flag.NewFlagSet(os.Args[0] + " serve", flag.ExitOnError)
 	dbFlag    = flags.String("db", "", "database connection string or URI")
-	tokenFlag = flags.String("token", "", "telegram bot API token")
+	tokenFlag = flags.String("token", "", "file containing the telegram bot API token")
 	chatFlag  = flags.Int("chat", math.MaxInt, "telegram bot chat ID")
+	imgLimits iutil.ImgLimits
+
+	imgDirFlag = flags.String("imgdir", "img", "image directory")
+
+	maxUploadsFlag = flags.Int("maxuploads", 2,
+		"maximum number of images processed at once (0 for no limit)")
+
+	tokenEnvFlag = flags.String("tokenenv", "",
+		"environment variable containing the telegram bot API token")
+
+	titleFlag   = flags.String("title", "Rock Buffet", "title of the shop")
+	tenantsFlag = flags.String("tenants", "",
+		"JSON file with the shops to serve by host name, instead of -db, -title, etc.")
+
+	configFlag = flags.String("config", "",
+		"JSON file with flag values; flags given explicitly take precedence")
+
+	cookieKeyFlag = flags.String("cookiekey", "",
+		"file containing the key for signing cookies (random if empty)")
+
+	apiTokensFlag = flags.String("apitokens", "",
+		"file containing SHA-256 hashes of API tokens, one per line")
+
+	maxItemsFlag = flags.Int("maxitems", 50, "maximum number of distinct items in an order")
+	maxQtyFlag   = flags.Int("maxqty", 500, "maximum total quantity of items in an order")
+	itemQtyFlag  = flags.Int("itemqty", 100,
+		"maximum quantity of an item in an order, unless set for the item")
+
+	webhookFlag    = flags.String("webhook", "", "URL to POST new orders to as JSON")
+	webhookKeyFlag = flags.String("webhookkey", "",
+		"file containing the key for signing webhook requests")
+
+	tgSecretFlag = flags.String("tgsecret", "", "file containing the secret of "+
+		"the telegram webhook at /tg, enabling buttons accepting or rejecting orders")
+
+	addrCheckFlag = flags.String("addrcheck", "",
+		"URL to POST delivery addresses to as JSON for checking")
+	addrCheckStrictFlag = flags.Bool("addrcheckstrict", false,
+		"refuse orders when the address checking service fails")
+
+	logFileFlag = flags.String("logfile", "",
+		"file to append logs to, reopened on SIGHUP (stderr if empty)")
+	logFile *os.File
+
+	baseURLFlag = flags.String("baseurl", "",
+		"public scheme and host of the shop for the sitemap (taken from requests if empty)")
+	prefixFlag = flags.String("prefix", "",
+		"path under which the shop is served, e.g. /shop (the root if empty)")
+	robotsAllow    strList
+	robotsDisallow strList
+
+	notesFlag lineList
+
+	langFlag = flags.String("lang", "en", "language of the item names and descriptions")
+	langs    strList
+
+	rates strList
+
+	menuSort   = iutil.ByName
+	adminSort  = iutil.ByName
+	searchSort = iutil.ByRelevance
+
+	trustedProxies netList
+
+	ogTitleFlag = flags.String("ogtitle", "", "title of the shop in link previews")
+	ogDescrFlag = flags.String("ogdescr", "", "description of the shop in link previews")
+	ogImageFlag = flags.String("ogimage", "",
+		"image URL for link previews (the logo or an item image if empty)")
 
 	//go:embed tmpl/*.tmpl tmpl/*.htmpl
 	tmplFS embed.FS
-	htmpls = htemplate.Must(htemplate.ParseFS(tmplFS, "tmpl/*.htmpl"))
-	tmpls  = template.Must(template.ParseFS(tmplFS, "tmpl/*.tmpl"))
 
 	//go:embed css/*.css
 	cssFS embed.FS
 
-	dbConn *pgx.Conn
-	dbLock sync.RWMutex
+	//go:embed favicon.ico
+	defaultFavicon []byte
+
+	tmplDirFlag = flags.String("tmpldir", "",
+		"directory with templates overriding the built-in ones")
+	cssDirFlag = flags.String("cssdir", "",
+		"directory with style sheets overriding the built-in ones")
+
+	avifCmdFlag = flags.String("avifcmd", "",
+		`shell command converting image $1 to AVIF in $2, e.g. avifenc "$1" "$2"`)
+	webpCmdFlag = flags.String("webpcmd", "",
+		`shell command converting image $1 to WebP in $2, e.g. cwebp -quiet "$1" -o "$2"`)
+	bcryptCostFlag = flags.Int("bcryptcost", bcrypt.DefaultCost,
+		"bcrypt cost of password hashes; lower ones are upgraded on login")
+
+	multiFlag = flags.Bool("multi", false,
+		"let other serve processes use the image directory at the same time")
+
+	animatedFlag = flags.String("animated", "allow",
+		"what to do with animated images: allow, reject, or flatten to the first frame")
 
-	intRE = regexp.MustCompile(`^0|[1-9][0-9]*$`)
+	heicCmdFlag = flags.String("heiccmd", "",
+		`shell command converting HEIC image $1 to JPEG in $2, e.g. heif-convert "$1" "$2"`)
 
-	tgConf *tutil.Conf
+	timeZoneFlag = flags.String("timezone", "",
+		"time zone of times shown, e.g. Asia/Tbilisi (local time if empty)")
+	timeFmtFlag = flags.String("timefmt", "2006-01-02 15:04",
+		"layout of times shown, as in Go's time package")
+	timeLoc = time.Local
+
+	deliveryFlag     = flags.String("delivery", "5", "price of delivery")
+	freeDeliveryFlag = flags.String("freedelivery", "",
+		"order total from which delivery is free (never if empty)")
+	minOrderFlag = flags.String("minorder", "", "minimum order total (none if empty)")
+	hoursFlag    = flags.String("hours", "",
+		"daily opening hours, e.g. 10:00-22:00 (always open if empty)")
+
+	tipsFlag = flags.String("tips", "10%,15%,20%",
+		"comma-separated tips suggested at checkout, as amounts or percentages")
+
+	msgHeaderFlag = flags.String("msgheader", "$shop",
+		"first line of telegram messages, with $shop and $time expanded (none if empty)")
+	msgFooterFlag = flags.String("msgfooter", "",
+		"last line of telegram messages, as for -msgheader")
+
+	cancelWindowFlag = flags.Duration("cancelwindow", 10*time.Minute,
+		"how long after ordering customers may cancel (0 to disallow)")
+
+	upsellFlag = flags.Int("upsell", 0,
+		"number of popular items suggested at checkout (0 for none)")
+
+	honeypotFlag = flags.Bool("honeypot", false,
+		"add a hidden field to the order form, refusing orders that fill it in")
+	minFillFlag = flags.Duration("minfill", 0,
+		"least time between showing the order form and checking out (0 for any)")
+
+	headerTimeoutFlag = flags.Duration("headertimeout", 10*time.Second,
+		"time allowed for reading the headers of a request (0 for -readtimeout)")
+	readTimeoutFlag = flags.Duration("readtimeout", time.Minute,
+		"time allowed for reading a whole request, uploads included (0 for no limit)")
+	writeTimeoutFlag = flags.Duration("writetimeout", time.Minute,
+		"time allowed for handling a request and writing the response (0 for no limit)")
+	idleTimeoutFlag = flags.Duration("idletimeout", 2*time.Minute,
+		"how long an idle keep-alive connection is kept (0 for -readtimeout)")
+
+	debugFlag = flags.String("debug", "",
+		"loopback address to serve pprof profiles on, e.g. 127.0.0.1:6060 (off if empty)")
+
+	dbCheckFlag = flags.Duration("dbcheck", 10*time.Second,
+		"interval between database health checks")
+	errDBDown = errors.New("database is unavailable")
+
+	intRE = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
 )
 
+// Shop is the configuration of a shop, one per tenant in the -tenants file.
+type Shop struct {
+	DB       string         `json:"db"`
+	Title    string         `json:"title"`
+	Currency iutil.Currency `json:"currency"`
+	Token    string         `json:"token"`    // file containing the token
+	TokenEnv string         `json:"tokenenv"` // or variable containing it
+	Chat     int            `json:"chat"`
+	Notes    []string       `json:"notes"` // shown under the menu
+	Lang     string         `json:"lang"`  // of the items
+	Langs    []string       `json:"langs"` // the items may be translated to
+	Rates    []string       `json:"rates"` // as for -rates
+
+	// As for the flags of the same names.
+	Delivery     string `json:"delivery"`
+	FreeDelivery string `json:"freedelivery"`
+	MinOrder     string `json:"minorder"`
+	Hours        string `json:"hours"`
+	MsgHeader    string `json:"msgheader"`
+	MsgFooter    string `json:"msgfooter"`
+	Webhook      string `json:"webhook"`
+	AddrCheck    string `json:"addrcheck"`
+
+	// Files as for the flags of the same names, which only apply to a
+	// single shop, lest one shop's secrets open another's.
+	APITokens  string `json:"apitokens"`
+	WebhookKey string `json:"webhookkey"`
+	TgSecret   string `json:"tgsecret"`
+	CookieKey  string `json:"cookiekey"`
+}
+
+// Server serves a shop.  The connect and send functions may be replaced
+// before serving, e.g. with stubs.
+type Server struct {
+	cur    iutil.Currency
+	imgDir string // subdirectory of the image directory
+
+	lang  string
+	langs []string
+	rates []exRate
+	hours hours
+
+	dbStr   string
+	db      database
+	dbLock  sync.RWMutex
+	dbUp    atomic.Bool
+	dbCheck chan struct{} // wakes superviseDB early
+	connect func(s string) (db database, err error)
+
+	tg        *tutil.Conf
+	tgSecret  []byte // of the webhook, if the order buttons are enabled
+	send      func(conf *tutil.Conf, msg string, buttons []tutil.Button) (err error)
+	notes     chan note // order notifications for notifier
+	noteWG    sync.WaitGroup
+	noteStop  chan struct{} // closed on shutdown to stop the retries
+	msgHeader string
+	msgFooter string
+
+	assets     atomic.Pointer[assets]
+	defaults   atomic.Pointer[shopConf] // as given by the flags, reloaded on SIGHUP
+	conf       atomic.Pointer[shopConf]
+	cookieKey  []byte
+	webhook    string // URL to POST new orders to, if any
+	webhookKey []byte
+	addrCheck  addrChecker
+	apiTokens  map[string]bool
+	uploadSem  chan struct{}
+}
+
+// NewServer makes a Server for shop, keeping its images in imgDir under
+// the image directory.  The cookie key is random unless shop gives one.
+func NewServer(shop Shop, imgDir string) (srv *Server, err error) {
+	tg, err := tutil.LoadConf(shop.Token, shop.TokenEnv, shop.Chat)
+	if err != nil {
+		return nil, err
+	}
+
+	srv = &Server{
+		cur:     shop.Currency,
+		imgDir:  imgDir,
+		dbStr:   shop.DB,
+		dbCheck: make(chan struct{}, 1),
+		connect: func(s string) (db database, err error) {
+			conn, err := util.DBConnect(s)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+		tg:        tg,
+		msgHeader: shop.MsgHeader,
+		msgFooter: shop.MsgFooter,
+		lang:      shop.Lang,
+		langs:     shop.Langs,
+		send:      tutil.SendButtons,
+		notes:     make(chan note, noteQueue),
+		noteStop:  make(chan struct{}),
+		cookieKey: make([]byte, 32),
+		addrCheck: noAddrCheck{},
+		apiTokens: make(map[string]bool),
+	}
+
+	for _, s := range shop.Rates {
+		x, err := parseRate(s)
+		if err != nil {
+			return nil, err
+		}
+		srv.rates = append(srv.rates, x)
+	}
+	if err = srv.setDefaults(shop); err != nil {
+		return nil, err
+	}
+	if srv.hours, err = parseHours(shop.Hours); err != nil {
+		return nil, err
+	}
+
+	a, err := loadAssets()
+	if err != nil {
+		return nil, err
+	}
+	srv.assets.Store(a)
+
+	if shop.CookieKey != "" {
+		if srv.cookieKey, err = os.ReadFile(shop.CookieKey); err != nil {
+			return nil, err
+		}
+	} else if _, err = rand.Read(srv.cookieKey); err != nil {
+		return nil, err
+	}
+	srv.webhook = shop.Webhook
+	if shop.AddrCheck != "" {
+		srv.addrCheck = httpAddrCheck{shop.AddrCheck}
+	}
+	if shop.APITokens != "" {
+		if err = srv.readAPITokens(shop.APITokens); err != nil {
+			return nil, err
+		}
+	}
+	if shop.WebhookKey != "" {
+		if srv.webhookKey, err = readSecret(shop.WebhookKey); err != nil {
+			return nil, err
+		}
+	}
+	if shop.TgSecret != "" {
+		if srv.tgSecret, err = readSecret(shop.TgSecret); err != nil {
+			return nil, err
+		}
+	}
+	if *maxUploadsFlag > 0 {
+		srv.uploadSem = make(chan struct{}, *maxUploadsFlag)
+	}
+
+	return srv, nil
+}
+
+// Handler returns the handler for all the pages of srv.
+func (srv *Server) Handler() (h http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", logged(srv.handleRoot))
+	mux.HandleFunc("/admin", logged(srv.handleAdmin))
+	mux.HandleFunc("POST /admin/upload", logged(srv.handleUpload))
+	mux.HandleFunc("GET /img/{path...}", logged(srv.handleImg))
+	mux.HandleFunc("DELETE /img/{path...}", logged(srv.handleImgDel))
+	mux.HandleFunc("GET /css/{base}", logged(srv.handleCSS))
+	mux.HandleFunc("GET /favicon.ico", logged(srv.handleFavicon))
+	mux.HandleFunc("GET /robots.txt", logged(handleRobots))
+	mux.HandleFunc("GET /sitemap.xml", logged(srv.handleSitemap))
+	mux.HandleFunc("GET /item/{key}", logged(srv.handleItem))
+	mux.HandleFunc("POST /order/cancel", logged(srv.handleOrderCancel))
+	mux.HandleFunc("POST /tg", logged(srv.handleTg))
+	mux.HandleFunc("GET /api/items", logged(srv.handleAPIItems))
+	mux.HandleFunc("GET /api/items/{id}", logged(srv.handleAPIItems))
+	mux.HandleFunc("/", logged(func(w http.ResponseWriter, r *http.Request) {
+		// The catch-all gets the methods the routes above lack too.
+		if allow := allowedMethods(mux, r); len(allow) > 0 {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			handleError(w, r, "", http.StatusMethodNotAllowed, "")
+			return
+		}
+		srv.handleNotFound(w, r)
+	}))
+
+	// Probes are frequent, so they aren't logged.
+	mux.HandleFunc("GET /livez", handleLive)
+	mux.HandleFunc("GET /readyz", srv.handleReady)
+	if *prefixFlag == "" {
+		return mux
+	}
+
+	outer := http.NewServeMux()
+	outer.Handle(*prefixFlag+"/", http.StripPrefix(*prefixFlag, mux))
+	return outer
+}
+
+func init() {
+	flags.IntVar(&imgLimits.Width, "maxwidth", 8000, "maximum image width (0 for no limit)")
+	flags.IntVar(&imgLimits.Height, "maxheight", 8000,
+		"maximum image height (0 for no limit)")
+	flags.IntVar(&imgLimits.Pixels, "maxpixels", 40000000,
+		"maximum number of pixels in an image (0 for no limit)")
+
+	flags.Var(&robotsAllow, "robotsallow",
+		"comma-separated paths allowed to robots (may be repeated)")
+	flags.Var(&robotsDisallow, "robotsdisallow",
+		"comma-separated paths disallowed to robots besides /admin (may be repeated)")
+	flags.Var(&trustedProxies, "trustedproxies",
+		"comma-separated addresses or networks of proxies trusted to give the client address")
+	flags.Var(&notesFlag, "note", "note shown under the menu (may be repeated)")
+	flags.Var(&langs, "langs", "comma-separated languages items may be translated to")
+	flags.Var(&menuSort, "menusort", "order of the items of the menu: id, name or price")
+	flags.Var(&adminSort, "adminsort",
+		"order of the items in the admin area, unless chosen there: id, name or price")
+	flags.Var(&searchSort, "searchsort",
+		"order of the results of a menu search: id, name, price or relevance")
+	flags.Var(&rates, "rates", "comma-separated exchange rates for showing approximate "+
+		"prices in other currencies, as CODE=RATE or CODE/DECIMALS=RATE, e.g. USD=0.37")
+
+	iutil.CurFlags(flags)
+}
+
+// strList is a flag.Value collecting comma-separated strings.
+type strList []string
+
+func (l *strList) Set(s string) (err error) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func (l *strList) String() (s string) {
+	return strings.Join(*l, ",")
+}
+
+// lineList is a flag.Value collecting each string given to it whole,
+// commas and all.
+type lineList []string
+
+func (l *lineList) Set(s string) (err error) {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *lineList) String() (s string) {
+	return strings.Join(*l, "\n")
+}
+
+// netList is a flag.Value collecting comma-separated addresses and
+// networks.
+type netList []netip.Prefix
+
+func (l *netList) Set(s string) (err error) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		var p netip.Prefix
+		if strings.Contains(v, "/") {
+			p, err = netip.ParsePrefix(v)
+		} else {
+			var a netip.Addr
+			if a, err = netip.ParseAddr(v); err == nil {
+				p = netip.PrefixFrom(a, a.BitLen())
+			}
+		}
+		if err != nil {
+			return err
+		}
+		*l = append(*l, p.Masked())
+	}
+	return nil
+}
+
+func (l *netList) String() (s string) {
+	var v []string
+	for _, p := range *l {
+		v = append(v, p.String())
+	}
+	return strings.Join(v, ",")
+}
+
+func (l netList) contains(addr string) (ok bool) {
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range l {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// fmtTime formats t for display, in -timezone by -timefmt.
+func fmtTime(t time.Time) (s string) {
+	return t.In(timeLoc).Format(*timeFmtFlag)
+}
+
+// prefixed returns the URL path of p, a path of the shop.
+func prefixed(p string) (u string) {
+	return *prefixFlag + p
+}
+
 func imgPath(base string) (p string) {
-	return path.Clean("/" + util.ImgPath(base))
+	return prefixed(path.Clean("/img/" + base))
+}
+
+// logoPath returns the URL path of the logo, or "" if there is none.
+func (srv *Server) logoPath() (p string, err error) {
+	imgs, err := iutil.Branding(srv.db)
+	if err != nil {
+		return "", err
+	}
+	if img, ok := imgs[iutil.Logo]; ok {
+		return imgPath(img), nil
+	}
+	return "", nil
+}
+
+// assets are the templates and style sheets, replaced as a whole on reload.
+type assets struct {
+	htmpls *htemplate.Template
+	tmpls  *template.Template
+	css    fs.FS
+}
+
+// loadAssets parses the templates and finds the style sheets, either the
+// built-in ones or those in -tmpldir and -cssdir.
+func loadAssets() (a *assets, err error) {
+	a = new(assets)
+
+	var tfs fs.FS
+	if tfs, err = fs.Sub(tmplFS, "tmpl"); err != nil {
+		return nil, err
+	}
+	if *tmplDirFlag != "" {
+		tfs = os.DirFS(*tmplDirFlag)
+	}
+	a.htmpls = htemplate.New("").Funcs(htemplate.FuncMap{
+		"path":    prefixed,
+		"fmtTime": fmtTime,
+		"fmtRate": iutil.FormatRate,
+	})
+	if a.htmpls, err = a.htmpls.ParseFS(tfs, "*.htmpl"); err != nil {
+		return nil, err
+	}
+	a.tmpls = template.New("").Funcs(template.FuncMap{"fmtTime": fmtTime})
+	if a.tmpls, err = a.tmpls.ParseFS(tfs, "*.tmpl"); err != nil {
+		return nil, err
+	}
+
+	if a.css, err = fs.Sub(cssFS, "css"); err != nil {
+		return nil, err
+	}
+	if *cssDirFlag != "" {
+		a.css = os.DirFS(*cssDirFlag)
+	}
+
+	return a, nil
+}
+
+// reload reloads the templates and style sheets of srv and, if shop is
+// given, sets the default shopConf from it anew.
+func (srv *Server) reload(shop *Shop) {
+	a, err := loadAssets()
+	if err != nil {
+		errLog.Print("reload failed: ", err)
+		return
+	}
+	srv.assets.Store(a)
+	log.Print("reloaded templates and style sheets")
+
+	if shop == nil {
+		return
+	}
+	if err = srv.setDefaults(*shop); err != nil {
+		errLog.Print("reloading the shop settings: ", err)
+		return
+	}
+	// Merge the stored settings over the new defaults now, rather than
+	// once a page is loaded.
+	if srv.dbConnFix() == nil {
+		srv.loadConf()
+		srv.dbLock.RUnlock()
+	}
+	log.Print("reloaded the shop settings")
+}
+
+// openLog (re)opens the log file and directs both the access and the error
+// log to it.
+func openLog() (err error) {
+	f, err := os.OpenFile(*logFileFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	errLog.SetOutput(f)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
 }
 
 func getMethodLine(r *http.Request) (line string) {
 	return r.Method + " " + r.URL.Path + " " + r.Proto
 }
 
+// logWriter records the status and the number of bytes sent to the client,
+// so that the access log reflects the actual response.
+type logWriter struct {
+	http.ResponseWriter
+	user   string
+	status int
+	size   int
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Write(b []byte) (n int, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func setUser(w http.ResponseWriter, user string) {
+	if lw, ok := w.(*logWriter); ok {
+		lw.user = user
+	}
+}
+
 func logAccess(r *http.Request, user string, size int, status int) {
 	if user == "" {
 		user = "-"
@@ -106,6 +726,69 @@ func logAccess(r *http.Request, user string, size int, status int) {
 		getMethodLine(r), status, size)
 }
 
+// forwardedFor returns the addresses a request was forwarded for, by the
+// Forwarded header or else by X-Forwarded-For, from the first to the last.
+func forwardedFor(r *http.Request) (addrs []string) {
+	for _, h := range r.Header.Values("Forwarded") {
+		for _, elem := range strings.Split(h, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if !strings.EqualFold(k, "for") {
+					continue
+				}
+				v = strings.Trim(v, `"`)
+				if host, _, err := net.SplitHostPort(v); err == nil {
+					v = host
+				}
+				addrs = append(addrs, strings.Trim(v, "[]"))
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, v := range strings.Split(h, ",") {
+			addrs = append(addrs, strings.TrimSpace(v))
+		}
+	}
+	return addrs
+}
+
+// clientAddr returns the address of the client of r.  If r comes from a
+// trusted proxy, it is the last address it was forwarded for that isn't
+// one of the trusted proxies; otherwise it is r.RemoteAddr.
+func clientAddr(r *http.Request) (addr string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !trustedProxies.contains(host) {
+		return r.RemoteAddr
+	}
+
+	addrs := forwardedFor(r)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if !trustedProxies.contains(addrs[i]) {
+			return addrs[i]
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	return r.RemoteAddr
+}
+
+func logged(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = clientAddr(r)
+		lw := &logWriter{ResponseWriter: w}
+		h(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		logAccess(r, lw.user, lw.size, lw.status)
+	}
+}
+
 func logError(r *http.Request, user string, status int, err error) {
 	var msg string
 	if err != nil {
@@ -119,29 +802,57 @@ func handleError(w http.ResponseWriter, r *http.Request, user string, status int
 	if msg != "" {
 		msg = ": " + msg
 	}
+	setUser(w, user)
 	http.Error(w, fmt.Sprint(status, " ", http.StatusText(status), msg), status)
-	logAccess(r, user, 0, status)
 }
 
 func logAndHandleError(w http.ResponseWriter, r *http.Request, user string,
 	status int, msg string, err error) {
 
 	if err != nil {
-		logError(r, "", status, err)
+		logError(r, user, status, err)
+	}
+	handleError(w, r, user, status, msg)
+}
+
+// logAndHandleDBError responds to a failed database operation: with 503
+// and Retry-After if the database is unreachable, or else with 500.
+func (srv *Server) logAndHandleDBError(w http.ResponseWriter, r *http.Request, user string, err error) {
+	var netErr net.Error
+	if errors.Is(err, errDBDown) || errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+
+		if !errors.Is(err, errDBDown) {
+			srv.dbUp.Store(false)
+			select {
+			case srv.dbCheck <- struct{}{}:
+			default:
+			}
+		}
+		retry := max(1, int(dbCheckFlag.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		logAndHandleError(w, r, user, http.StatusServiceUnavailable, "", err)
+		return
 	}
-	handleError(w, r, "", status, "")
+	logAndHandleError(w, r, user, http.StatusInternalServerError, "", err)
 }
 
-func getForm(w http.ResponseWriter, r *http.Request) (code int, err error) {
+// getForm parses the request body.  A body is only accepted with one of the
+// given methods, POST if none are given.
+func getForm(w http.ResponseWriter, r *http.Request, methods ...string) (code int, err error) {
 	ct := r.Header.Get("Content-Type")
 	if ct == "" {
 		goto ok
 	}
 
-	if r.Method != http.MethodPost {
-		w.Header().Set("Allow", http.MethodPost)
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost}
+	}
+	if !slices.Contains(methods, r.Method) {
+		allow := strings.Join(methods, ", ")
+		w.Header().Set("Allow", allow)
 		return http.StatusMethodNotAllowed,
-			errors.New(r.Method + " used instead of POST")
+			errors.New(r.Method + " used instead of " + allow)
 	}
 	ct, _, err = mime.ParseMediaType(ct)
 	if err != nil {
@@ -152,7 +863,10 @@ func getForm(w http.ResponseWriter, r *http.Request) (code int, err error) {
 	case "multipart/form-data":
 		err = r.ParseMultipartForm(10 << 20) // 10 MiB
 	case "application/x-www-form-urlencoded":
+		// ParseForm only reads the body of POST, PUT and PATCH.
 		err = r.ParseForm()
+	case "application/json":
+		err = parseJSON(w, r)
 	default:
 		return http.StatusUnsupportedMediaType, errors.New("bad Content-Type " + ct)
 	}
@@ -164,6 +878,96 @@ ok:
 	return http.StatusOK, nil
 }
 
+// jsonForm is the JSON counterpart of the HTML forms.  Items maps item IDs
+// to ordered quantities.
+type jsonForm struct {
+	Action    string         `json:"action"`
+	ID        json.Number    `json:"id"`
+	Name      string         `json:"name"`
+	Descr     string         `json:"descr"`
+	Price     json.Number    `json:"price"`
+	VAT       json.Number    `json:"vat"`
+	MaxQty    json.Number    `json:"maxqty"`
+	ImgURL    string         `json:"img_url"`
+	ImgStaged string         `json:"img_staged"`
+	Variants  *string        `json:"variants"`
+	Modifiers *string        `json:"modifiers"`
+	Contact   string         `json:"contact"`
+	Address   string         `json:"address"`
+	Comments  string         `json:"comments"`
+	Tip       string         `json:"tip"`
+	Items     map[string]int `json:"items"`
+
+	// Chosen variants and modifiers by item ID.
+	Sizes map[string]string   `json:"sizes"`
+	Extra map[string][]string `json:"extra"`
+}
+
+// parseJSON decodes a jsonForm from the request body and stores it in
+// r.PostForm and r.Form, so that handlers need not care how the request
+// was encoded.
+func parseJSON(w http.ResponseWriter, r *http.Request) (err error) {
+	var req jsonForm
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)) // 1 MiB
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&req); err != nil {
+		return err
+	}
+
+	form := make(url.Values)
+	set := func(k, v string) {
+		if v != "" {
+			form.Set(k, v)
+		}
+	}
+	set("action", req.Action)
+	set("id", req.ID.String())
+	set("name", req.Name)
+	set("descr", req.Descr)
+	set("price", req.Price.String())
+	set("vat", req.VAT.String())
+	set("maxqty", req.MaxQty.String())
+	set("img_url", req.ImgURL)
+	set("img_staged", req.ImgStaged)
+	if req.Variants != nil {
+		form.Set("variants", *req.Variants)
+	}
+	if req.Modifiers != nil {
+		form.Set("modifiers", *req.Modifiers)
+	}
+	set("contact", req.Contact)
+	set("address", req.Address)
+	set("comments", req.Comments)
+	set("tip", req.Tip)
+	for id, n := range req.Items {
+		form.Set("item["+id+"]", strconv.Itoa(n))
+	}
+	for id, v := range req.Sizes {
+		form.Set("variant_"+id, v)
+	}
+	for id, l := range req.Extra {
+		form["mod_"+id] = l
+	}
+
+	r.PostForm = form
+	r.Form = r.URL.Query()
+	for k, v := range form {
+		r.Form[k] = append(v, r.Form[k]...)
+	}
+	return nil
+}
+
+// mediaType returns the media type of the Content-Type ct in lower case
+// and without parameters, or "" if ct is malformed.
+func mediaType(ct string) (typ string) {
+	typ, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ""
+	}
+	return typ
+}
+
 func formGetFile(w http.ResponseWriter, r *http.Request, fld string) (f multipart.File,
 	fh *multipart.FileHeader, code int, err error) {
 
@@ -184,46 +988,96 @@ func formGetFile(w http.ResponseWriter, r *http.Request, fld string) (f multipar
 		return nil, nil, http.StatusOK, nil
 	}
 
-	hdrCT := fh.Header.Get("Content-Type")
-	extCT := mime.TypeByExtension(path.Ext(fh.Filename))
-	if hdrCT != extCT {
-		return badct()
-	}
-	if typ, _, ok := strings.Cut(extCT, "/"); !ok || typ != "image" {
-		return badct()
-	}
+	// A single Read may return less than what DetectContentType looks
+	// at, so fill the buffer unless the file is shorter.
 	buf := make([]byte, 512)
-	nbytes, err := f.Read(buf)
-	if err != nil && err != io.EOF {
+	nbytes, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return bad(http.StatusInternalServerError, err)
 	}
 	if _, err = f.Seek(0, 0); err != nil {
 		return bad(http.StatusInternalServerError, err)
 	}
-	if hdrCT != http.DetectContentType(buf[:nbytes]) {
+
+	// Neither mime nor http know HEIC, and image can't decode it, so it
+	// is only recognized by its contents here, and converted and checked
+	// against the limits by copyImg.
+	if iutil.IsHEIC(buf[:nbytes]) {
+		if iutil.HEICConverter == "" {
+			return bad(http.StatusBadRequest, errors.New("HEIC images are not supported"))
+		}
+		return f, fh, http.StatusOK, nil
+	}
+
+	hdrCT := iutil.CanonImgType(mediaType(fh.Header.Get("Content-Type")))
+	if extCT := iutil.ImgType(fh.Filename); hdrCT == "" || hdrCT != extCT {
+		return badct()
+	}
+	if hdrCT != mediaType(http.DetectContentType(buf[:nbytes])) {
 		return badct()
 	}
+	if err = iutil.CheckImg(f, imgLimits); err != nil {
+		return bad(http.StatusBadRequest, err)
+	}
+	flat, err := checkAnimated(f)
+	if err != nil {
+		return bad(http.StatusBadRequest, err)
+	}
+	if flat != nil {
+		f.Close()
+		f = memFile{bytes.NewReader(flat)}
+	}
 
 	return f, fh, http.StatusOK, nil
 }
 
-func itemAdd(w http.ResponseWriter, r *http.Request) (code int, err error) {
-	var it iutil.Item
-
-	name := r.FormValue("name")
-	if name == "" {
-		return http.StatusBadRequest, errors.New("no name")
+// checkAnimated applies -animated to the image in r.  If the image is
+// animated, it is refused, or flattened to its first frame, returned as
+// flat.  Otherwise flat is nil.
+func checkAnimated(r io.ReadSeeker) (flat []byte, err error) {
+	if *animatedFlag == "allow" {
+		return nil, nil
 	}
-	it.Name = &name
-
-	f, fh, status, err := formGetFile(w, r, "image")
-	if err != nil {
-		return status, err
+	anim, err := iutil.IsAnimated(r)
+	if err != nil || !anim {
+		return nil, err
 	}
-	if f != nil {
-		defer f.Close()
-		it.Img.Name = &fh.Filename
-		it.Img.Reader = f
+	if *animatedFlag == "reject" {
+		return nil, errors.New("animated images are not allowed")
+	}
+	flat, err = iutil.Flatten(r)
+	if err != nil {
+		return nil, errors.New("flattening animated image: " + err.Error())
+	}
+	return flat, nil
+}
+
+// memFile is a multipart.File in memory.
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() (err error) {
+	return nil
+}
+
+func (srv *Server) itemAdd(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	var it iutil.Item
+	errs := make(fieldErrors)
+
+	name := r.FormValue("name")
+	if name == "" {
+		errs["name"] = "required"
+	}
+	it.Name = &name
+
+	if code, err = srv.formImg(w, r, &it, errs); err != nil {
+		return code, err
+	}
+	if it.Img.Reader != nil {
+		if c, ok := it.Img.Reader.(io.Closer); ok {
+			defer c.Close()
+		}
 	}
 
 	descr := r.FormValue("descr")
@@ -231,13 +1085,46 @@ func itemAdd(w http.ResponseWriter, r *http.Request) (code int, err error) {
 		it.Descr = &descr
 	}
 
-	var price int
-	if err := (*iutil.Price)(&price).Set(r.FormValue("price")); err != nil {
-		return http.StatusBadRequest, errors.New("invalid price")
+	price, err := srv.cur.Parse(r.FormValue("price"))
+	if err != nil {
+		errs["price"] = "invalid price"
 	}
 	it.Price = &price
 
-	if err := iutil.Add(dbConn, &it); err != nil {
+	if s := r.FormValue("vat"); s != "" {
+		vat, err := iutil.ParseRate(s)
+		if err != nil {
+			errs["vat"] = err.Error()
+		}
+		it.VAT = &vat
+	}
+
+	if s := r.FormValue("maxqty"); s != "" {
+		n, err := parseMaxQty(s)
+		if err != nil {
+			errs["maxqty"] = err.Error()
+		}
+		it.MaxQty = &n
+	}
+
+	if it.Variants, err = srv.cur.ParseVariants(r.FormValue("variants")); err != nil {
+		errs["variants"] = err.Error()
+	}
+	if it.Modifiers, err = srv.cur.ParseModifiers(r.FormValue("modifiers")); err != nil {
+		errs["modifiers"] = err.Error()
+	}
+
+	if len(errs) > 0 {
+		return http.StatusBadRequest, errs
+	}
+
+	var taken *iutil.NameTakenError
+	var imgErr *iutil.ImgError
+	if _, err := iutil.Add(r.Context(), srv.db, &it); errors.As(err, &taken) {
+		return http.StatusBadRequest, fieldErrors{"name": "already exists"}
+	} else if errors.As(err, &imgErr) {
+		return http.StatusBadRequest, fieldErrors{"image": imgErr.Error()}
+	} else if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
@@ -245,8 +1132,9 @@ func itemAdd(w http.ResponseWriter, r *http.Request) (code int, err error) {
 }
 
 // XXX This is almost exactly the same as itemadd.
-func itemMod(w http.ResponseWriter, r *http.Request) (code int, err error) {
+func (srv *Server) itemMod(w http.ResponseWriter, r *http.Request) (code int, err error) {
 	var it iutil.Item
+	errs := make(fieldErrors)
 
 	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
@@ -258,48 +1146,339 @@ func itemMod(w http.ResponseWriter, r *http.Request) (code int, err error) {
 		it.Name = &name
 	}
 
-	f, fh, status, err := formGetFile(w, r, "image")
-	if err != nil {
-		return status, err
+	// Images are removed by the imgdel action.
+	if code, err = srv.formImg(w, r, &it, errs); err != nil {
+		return code, err
 	}
-	if f != nil {
-		defer f.Close()
-		it.Img.Name = &fh.Filename
-		it.Img.Reader = f
+	if it.Img.Reader != nil {
+		if c, ok := it.Img.Reader.(io.Closer); ok {
+			defer c.Close()
+		}
 	}
 
 	descr := r.FormValue("descr")
-	if descr != "" {
+	if r.FormValue("nodescr") != "" {
+		descr = ""
+		it.Descr = &descr
+	} else if descr != "" {
 		it.Descr = &descr
 	}
 
-	var price int
 	if s := r.FormValue("price"); s != "" {
-		if err := (*iutil.Price)(&price).Set(r.FormValue("price")); err != nil {
-			return http.StatusBadRequest, errors.New("invalid price")
+		price, err := srv.cur.Parse(s)
+		if err != nil {
+			errs["price"] = "invalid price"
 		}
 		it.Price = &price
 	}
 
-	if err := iutil.Mod(dbConn, id, "", &it); err != nil {
+	if s := r.FormValue("vat"); s != "" {
+		vat, err := iutil.ParseRate(s)
+		if err != nil {
+			errs["vat"] = err.Error()
+		}
+		it.VAT = &vat
+	}
+
+	if _, ok := r.Form["maxqty"]; ok {
+		n, err := parseMaxQty(r.FormValue("maxqty"))
+		if err != nil {
+			errs["maxqty"] = err.Error()
+		}
+		it.MaxQty = &n
+	}
+
+	if _, ok := r.Form["variants"]; ok {
+		if it.Variants, err = srv.cur.ParseVariants(r.FormValue("variants")); err != nil {
+			errs["variants"] = err.Error()
+		}
+	}
+
+	if _, ok := r.Form["modifiers"]; ok {
+		it.Modifiers, err = srv.cur.ParseModifiers(r.FormValue("modifiers"))
+		if err != nil {
+			errs["modifiers"] = err.Error()
+		}
+	}
+
+	trans := make(map[string]iutil.Translation)
+	for _, l := range srv.langs {
+		if _, ok := r.Form["name_"+l]; ok {
+			trans[l] = iutil.Translation{
+				Name:  strings.TrimSpace(r.FormValue("name_" + l)),
+				Descr: strings.TrimSpace(r.FormValue("descr_" + l)),
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return http.StatusBadRequest, errs
+	}
+
+	var taken *iutil.NameTakenError
+	var imgErr *iutil.ImgError
+	err = iutil.Mod(r.Context(), srv.db, id, "", &it)
+	if errors.Is(err, iutil.ErrNoChange) && len(trans) == 0 {
+		return http.StatusOK, err
+	} else if errors.Is(err, iutil.ErrNoItem) {
+		return http.StatusNotFound, err
+	} else if errors.As(err, &taken) {
+		return http.StatusBadRequest, fieldErrors{"name": "already exists"}
+	} else if errors.As(err, &imgErr) {
+		return http.StatusBadRequest, fieldErrors{"image": imgErr.Error()}
+	} else if err != nil && !errors.Is(err, iutil.ErrNoChange) {
 		return http.StatusInternalServerError, err
 	}
 
+	for l, t := range trans {
+		if err = iutil.SetTranslation(srv.db, id, l, t); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// formImg sets the image of it from the uploaded image or the image URL,
+// adding what is wrong with them to errs.  Other errors are returned.
+func (srv *Server) formImg(w http.ResponseWriter, r *http.Request, it *iutil.Item,
+	errs fieldErrors) (code int, err error) {
+
+	f, fh, status, err := formGetFile(w, r, "image")
+	if err != nil {
+		if status != http.StatusBadRequest {
+			return status, err
+		}
+		errs["image"] = err.Error()
+		return http.StatusOK, nil
+	}
+	if f != nil {
+		it.Img.Name = &fh.Filename
+		it.Img.Reader = f
+		it.Img.Dir = srv.imgDir
+	} else if u := r.FormValue("img_url"); u != "" {
+		name, r, err := iutil.FetchImg(r.Context(), u)
+		var flat []byte
+		if err == nil && !fetchedHEIC(r) {
+			// HEIC is converted and checked by copyImg, as in
+			// formGetFile.
+			if err = iutil.CheckImg(r, imgLimits); err == nil {
+				flat, err = checkAnimated(r)
+			}
+		}
+		if err != nil {
+			errs["img_url"] = err.Error()
+			return http.StatusOK, nil
+		}
+		if flat != nil {
+			r = bytes.NewReader(flat)
+		}
+		it.Img.Name = &name
+		it.Img.Reader = r
+		it.Img.Dir = srv.imgDir
+	} else if s := r.FormValue("img_staged"); s != "" {
+		// Only the shop's own uploads.
+		if path.Dir(s) != path.Clean(srv.imgDir) {
+			errs["img_staged"] = "invalid image name"
+			return http.StatusOK, nil
+		}
+		if err := iutil.CheckStaged(s); err != nil {
+			errs["img_staged"] = err.Error()
+			return http.StatusOK, nil
+		}
+		it.Img.Name = &s
+		it.Img.Staged = true
+	}
+	return http.StatusOK, nil
+}
+
+// fetchedHEIC reports whether the image in r, as returned by
+// iutil.FetchImg, is HEIC, leaving r at its start.
+func fetchedHEIC(r io.ReadSeeker) (ok bool) {
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(r, head)
+	r.Seek(0, io.SeekStart)
+	return iutil.IsHEIC(head[:n])
+}
+
+// fieldErrors maps form fields to what is wrong with them.
+type fieldErrors map[string]string
+
+func (e fieldErrors) Error() (s string) {
+	var l []string
+	for _, k := range slices.Sorted(maps.Keys(e)) {
+		l = append(l, k+": "+e[k])
+	}
+	return strings.Join(l, "; ")
+}
+
+// uploadWait is how long to wait for a free upload slot.
+const uploadWait = 5 * time.Second
+
+// acquireUpload takes one of the -maxuploads slots for processing images,
+// waiting a little if they are all taken.
+func (srv *Server) acquireUpload(ctx context.Context) (ok bool) {
+	if srv.uploadSem == nil {
+		return true
+	}
+	t := time.NewTimer(uploadWait)
+	defer t.Stop()
+	select {
+	case srv.uploadSem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (srv *Server) releaseUpload() {
+	if srv.uploadSem != nil {
+		<-srv.uploadSem
+	}
+}
+
+func uploadBusy(w http.ResponseWriter, r *http.Request, user string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(uploadWait.Seconds())))
+	logAndHandleError(w, r, user, http.StatusServiceUnavailable, "too many uploads",
+		errors.New("too many uploads"))
+}
+
+// handleUpload stages the uploaded image, to be given to an item later by
+// its name as img_staged, and responds with the name and URL path it will
+// have.
+func (srv *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	if code, err := srv.auth(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, "", code, "", err)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	setUser(w, user)
+
+	if !srv.acquireUpload(r.Context()) {
+		uploadBusy(w, r, user)
+		return
+	}
+	defer srv.releaseUpload()
+
+	if code, err := getForm(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, user, code, "", err)
+		return
+	}
+	f, fh, code, err := formGetFile(w, r, "image")
+	if err == nil && f == nil {
+		code, err = http.StatusBadRequest, errors.New("no image")
+	}
+	if err != nil {
+		logAndHandleError(w, r, user, code, "", err)
+		return
+	}
+
+	img, err := iutil.StageImg(r.Context(), srv.imgDir, fh.Filename, f)
+	var imgErr *iutil.ImgError
+	if errors.As(err, &imgErr) {
+		logAndHandleError(w, r, user, http.StatusBadRequest, "", err)
+		return
+	} else if err != nil {
+		logAndHandleError(w, r, user, http.StatusInternalServerError, "", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Img string `json:"img"`
+		URL string `json:"url"`
+	}{img, imgPath(img)})
+}
+
+func (srv *Server) setBranding(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	for _, kind := range []string{iutil.Logo, iutil.Favicon} {
+		f, fh, status, err := formGetFile(w, r, kind)
+		if err != nil {
+			return status, err
+		}
+		if f == nil {
+			continue
+		}
+		defer f.Close()
+		if err = iutil.SetBranding(r.Context(), srv.db, kind, srv.imgDir, fh.Filename, f); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// itemDel deletes the items with the IDs in the form, returning a message
+// of how many.
+func (srv *Server) itemDel(w http.ResponseWriter, r *http.Request) (msg string, code int,
+	err error) {
+
+	var ids []int
+	for _, v := range r.Form["id"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return "", http.StatusBadRequest, errors.New("bad id")
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return "No items selected.", http.StatusOK, nil
+	}
+	n, err := iutil.Del(srv.db, ids, []string{})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return fmt.Sprintf("Deleted %v item(s).", n), http.StatusOK, nil
+}
+
+// imgDel removes the image of the item with the ID in the form.
+func (srv *Server) imgDel(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return http.StatusBadRequest, errors.New("bad id")
+	}
+	var it iutil.Item
+	noimg := ""
+	it.Img.Name = &noimg
+	err = iutil.Mod(r.Context(), srv.db, id, "", &it)
+	if errors.Is(err, iutil.ErrNoItem) {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
 	return http.StatusOK, nil
 }
 
-func itemDel(w http.ResponseWriter, r *http.Request) (code int, err error) {
+// soldOut marks an item as sold out for the rest of the day in the shop's
+// time zone, or as available again.
+func (srv *Server) soldOut(w http.ResponseWriter, r *http.Request,
+	out bool) (code int, err error) {
+
 	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
 		return http.StatusBadRequest, errors.New("bad id")
 	}
-	if err = iutil.Del(dbConn, []int{id}, []string{}); err != nil {
+	var until time.Time
+	if out {
+		y, m, d := time.Now().In(timeLoc).Date()
+		until = time.Date(y, m, d+1, 0, 0, 0, 0, timeLoc)
+	}
+	if err = iutil.SetSoldOut(srv.db, id, until); err != nil {
 		return http.StatusInternalServerError, err
 	}
 	return http.StatusOK, nil
 }
 
-func chpass(w http.ResponseWriter, r *http.Request) (code int, err error) {
+// chpass sets the password of user, the one logged in.
+func (srv *Server) chpass(w http.ResponseWriter, r *http.Request,
+	user string) (code int, err error) {
+
 	const min = 8
 
 	pass := r.FormValue("password")
@@ -313,18 +1492,33 @@ func chpass(w http.ResponseWriter, r *http.Request) (code int, err error) {
 		return http.StatusOK, errors.New("passwords do not match")
 	}
 
-	if err = putil.Chpass(dbConn, []byte(pass)); err != nil {
+	if _, err = putil.ChpassUser(srv.db, user, []byte(pass)); err != nil {
 		return http.StatusInternalServerError, err
 	}
 
 	return http.StatusOK, nil
 }
 
+// userDel deletes the user named in the form, returning a message of it.
+func (srv *Server) userDel(w http.ResponseWriter, r *http.Request) (msg string, code int,
+	err error) {
+
+	name := r.FormValue("name")
+	err = putil.DelUser(srv.db, name)
+	switch {
+	case errors.Is(err, putil.ErrNoUser), errors.Is(err, putil.ErrLastUser):
+		return "", http.StatusOK, errors.New(name + ": " + err.Error())
+	case err != nil:
+		return "", http.StatusInternalServerError, err
+	}
+	return "Deleted user " + name + ".", http.StatusOK, nil
+}
+
 func setAuthHeader(w http.ResponseWriter) {
 	w.Header().Set("WWW-Authenticate", `Basic realm="Admin Area"`)
 }
 
-func auth(w http.ResponseWriter, r *http.Request) (code int, err error) {
+func (srv *Server) auth(w http.ResponseWriter, r *http.Request) (code int, err error) {
 	var hash []byte
 
 	u, p, ok := r.BasicAuth()
@@ -339,7 +1533,7 @@ func auth(w http.ResponseWriter, r *http.Request) (code int, err error) {
 			errors.New("empty password login denied for " + u)
 	}
 
-	err = dbConn.QueryRow(context.Background(), "SELECT pass FROM passwd WHERE name = $1",
+	err = srv.db.QueryRow(context.Background(), "SELECT pass FROM passwd WHERE name = $1",
 		u).Scan(&hash)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -353,279 +1547,2493 @@ func auth(w http.ResponseWriter, r *http.Request) (code int, err error) {
 		return http.StatusUnauthorized, errors.New("failed login as " + u)
 	}
 
+	// The login went through anyway, so a failed upgrade is only logged.
+	if ok, err := putil.Upgrade(srv.db, u, []byte(p), hash); err != nil {
+		errLog.Print("upgrading password hash of ", u, ": ", err)
+	} else if ok {
+		log.Print("upgraded password hash of ", u)
+	}
+
 	return http.StatusOK, nil
 }
 
-func dbConnFix() (err error) {
-	dbLock.RLock()
-
-	if err = util.DBTest(dbConn); err != nil {
-		dbLock.RUnlock()
-
-		err = func() (err error) {
-			dbLock.Lock()
-			defer dbLock.Unlock()
-			dbConn = nil
-			if dbConn, err = util.DBConnect(*dbFlag); err != nil {
-				return err
-			}
-			return nil
-		}()
-		if err != nil {
-			return err
-		}
+// apiAuth checks the bearer token of API requests against apiTokens.
+func (srv *Server) apiAuth(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || tok == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="API"`)
+		return http.StatusUnauthorized, nil
+	}
 
-		dbLock.RLock()
+	sum := sha256.Sum256([]byte(tok))
+	if !srv.apiTokens[hex.EncodeToString(sum[:])] {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="API", error="invalid_token"`)
+		return http.StatusUnauthorized, errors.New("invalid API token")
 	}
-	return nil
+
+	return http.StatusOK, nil
 }
 
-func getItems(ids []int, names []string) (items []item, err error) {
-	dbItems, err := iutil.Get(dbConn, ids, names, iutil.ByName)
+// readSecret returns the contents of file, without surrounding space.
+func readSecret(file string) (secret []byte, err error) {
+	buf, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
+	return bytes.TrimSpace(buf), nil
+}
 
-	for i := range dbItems {
-		var it item
-		p := &dbItems[i]
-		it.ID = *p.ID
-		it.Ord = i
-		it.Name = *p.Name
-		it.Price.Num = *p.Price
-		it.Price.Str = (*iutil.Price)(p.Price).String()
-		if p.Descr != nil {
-			it.Descr = *p.Descr
-		}
-		if p.Img.Name != nil {
-			it.Img = imgPath(*p.Img.Name)
+func (srv *Server) readAPITokens(file string) (err error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Split(string(buf), "\n") {
+		if l = strings.ToLower(strings.TrimSpace(l)); l != "" {
+			srv.apiTokens[l] = true
 		}
-
-		items = append(items, it)
 	}
-
-	return items, nil
+	return nil
 }
 
-func handleAdmin(w http.ResponseWriter, r *http.Request) {
-	page := struct {
-		Title    string
-		Currency string
-		Message  string
-		Items    []item
-	}{
-		Title:    "Rock Buffet: Admin Area",
-		Currency: "GEL",
-	}
-
-	const user = "admin"
+// database is the connection to the database.  *pgx.Conn implements it.
+type database interface {
+	util.DB
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
 
-	if err := dbConnFix(); err != nil {
-		logAndHandleError(w, r, "", http.StatusInternalServerError, "", err)
-		return
+// dbConnFix read-locks the database connection, failing fast if the
+// database is down.  The caller must call dbLock.RUnlock on success.
+func (srv *Server) dbConnFix() (err error) {
+	if !srv.dbUp.Load() {
+		select {
+		case srv.dbCheck <- struct{}{}:
+		default:
+		}
+		return errDBDown
 	}
-	defer dbLock.RUnlock()
+	srv.dbLock.RLock()
+	return nil
+}
 
-	if code, err := auth(w, r); code != http.StatusOK {
-		logAndHandleError(w, r, "", code, "", err)
-		return
-	}
+// shutdownWait is how long to wait on shutdown for the requests to finish
+// and the notifications to be sent.
+const shutdownWait = 30 * time.Second
 
-	if code, err := getForm(w, r); code != http.StatusOK {
-		logAndHandleError(w, r, "", code, "", err)
-		return
-	}
+// noteQueue is how many order notifications may wait to be sent.
+const noteQueue = 100
 
-	var status int
-	var err error
-	if r.Method == http.MethodPost {
-		action := r.FormValue("action")
-		switch action {
-		case "chpass":
-			status, err = chpass(w, r)
-		case "itemadd":
-			status, err = itemAdd(w, r)
-		case "itemdel":
-			status, err = itemDel(w, r)
-		case "itemmod":
-			status, err = itemMod(w, r)
-		default:
-			status = http.StatusBadRequest
-			err = errors.New("bad action: " + action)
+// frame puts the message header and footer of srv around msg, so that
+// it tells which shop sent it and when.
+func (srv *Server) frame(msg string) (s string) {
+	expand := func(v string) string {
+		switch v {
+		case "shop":
+			return srv.shop().title
+		case "time":
+			return fmtTime(time.Now())
 		}
+		return "$" + v
 	}
-	if err != nil {
-		if status != http.StatusOK {
-			logAndHandleError(w, r, user, status, "", err)
-			return
-		}
-		page.Message = err.Error()
+	if h := os.Expand(srv.msgHeader, expand); h != "" {
+		msg = h + "\n\n" + msg
 	}
+	if f := os.Expand(srv.msgFooter, expand); f != "" {
+		msg = strings.TrimRight(msg, "\n") + "\n\n" + f
+	}
+	return msg
+}
 
-	page.Items, err = getItems([]int{}, []string{})
-	if err != nil {
-		logAndHandleError(w, r, user, http.StatusInternalServerError, "", err)
+// note is a notification to be sent to Telegram.
+type note struct {
+	msg     string
+	buttons []tutil.Button
+}
+
+// notify queues msg, framed, to be sent to Telegram by notifier, so that
+// the customer needn't wait for it.  If the queue is full, msg is dropped.
+func (srv *Server) notify(msg string) {
+	srv.notifyButtons(msg, nil)
+}
+
+// notifyButtons is like notify, but puts buttons under msg.
+func (srv *Server) notifyButtons(msg string, buttons []tutil.Button) {
+	if srv.tg == nil {
 		return
 	}
-
-	if err = htmpls.ExecuteTemplate(w, "admin.htmpl", page); err != nil {
-		logAndHandleError(w, r, "", http.StatusInternalServerError, "", err)
+	msg = srv.frame(msg)
+	select {
+	case srv.notes <- note{msg, buttons}:
+	default:
+		errLog.Print("telegram: queue full, dropping notification:\n", msg)
 	}
-	logAccess(r, "", 0, http.StatusOK)
 }
 
-func stoi(s string) (n int, err error) {
-	return strconv.Atoi(intRE.FindString(s))
+// orderButtons returns the buttons accepting and rejecting order id, or
+// none if they aren't enabled by -tgsecret.
+func (srv *Server) orderButtons(id int) (buttons []tutil.Button) {
+	if srv.tgSecret == nil {
+		return nil
+	}
+	for _, s := range orderStatuses {
+		buttons = append(buttons, tutil.Button{
+			Text: s.button,
+			Data: fmt.Sprintf("%v:%v", s.action, id),
+		})
+	}
+	return buttons
 }
 
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	var total iutil.Price
-	var err error
-	var ids []int
-	ordered := make(map[int]int)
+// noteTries is how many times notifier tries to send a notification.
+const noteTries = 5
 
-	const (
-		actCheckout = iota
-		actOrder
+// notifier sends the queued notifications, retrying a few times, until the
+// queue is closed and drained.  Once noteStop is closed, each notification
+// is tried only once, so that shutdown doesn't wait out the retries.
+func (srv *Server) notifier() {
+	defer srv.noteWG.Done()
+	for n := range srv.notes {
+		var err error
+	retry:
+		for i, wait := 1, time.Second; ; i, wait = i+1, wait*4 {
+			if err = srv.send(srv.tg, n.msg, n.buttons); err == nil {
+				break
+			}
+			errLog.Printf("telegram (attempt %v): %v", i, err)
+			if i == noteTries {
+				break
+			}
+			select {
+			case <-time.After(wait):
+			case <-srv.noteStop:
+				break retry
+			}
+		}
+		if err != nil {
+			errLog.Print("telegram: giving up on notification:\n", n.msg)
+		}
+	}
+}
+
+// checkDB pings the database, reconnecting if that fails, and records
+// whether it is up.
+func (srv *Server) checkDB() (err error) {
+	srv.dbLock.RLock()
+	err = util.DBTest(srv.db)
+	srv.dbLock.RUnlock()
+
+	if err != nil {
+		if srv.dbUp.Swap(false) {
+			errLog.Print("database is down: ", err)
+		}
+		var conn database
+		if conn, err = srv.connect(srv.dbStr); err != nil {
+			errLog.Print("connecting to database: ", err)
+			return err
+		}
+		srv.dbLock.Lock()
+		if srv.db != nil {
+			srv.db.Close(context.Background())
+		}
+		srv.db = conn
+		srv.dbLock.Unlock()
+	}
+
+	if !srv.dbUp.Swap(true) {
+		log.Print("database is up")
+	}
+	return nil
+}
+
+// superviseDB keeps the database connection alive, pinging it every
+// -dbcheck and reconnecting with backoff when it fails.
+func (srv *Server) superviseDB() {
+	const minBackoff, maxBackoff = time.Second, time.Minute
+	backoff := minBackoff
+
+	for {
+		if srv.dbUp.Load() {
+			select {
+			case <-time.After(*dbCheckFlag):
+			case <-srv.dbCheck:
+			}
+		}
+		if err := srv.checkDB(); err != nil {
+			time.Sleep(backoff)
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+	}
+}
+
+func (srv *Server) getItems(ids []int, names []string) (items []item, err error) {
+	dbItems, err := iutil.Get(srv.db, ids, names, menuSort)
+	if err != nil {
+		return nil, err
+	}
+	return srv.toItems(dbItems), nil
+}
+
+// getSlug returns the item with the given slug, if there is one.
+func (srv *Server) getSlug(slug string) (items []item, err error) {
+	dbItems, err := iutil.GetSlug(srv.db, slug)
+	if err != nil {
+		return nil, err
+	}
+	return srv.toItems(dbItems), nil
+}
+
+// upsellDays is how many days back the orders are that upsell finds the
+// popular items in.
+const upsellDays = 30
+
+// upsell returns the items to suggest at checkout besides those of ids:
+// up to -upsell of the ones ordered most lately, most ordered first.
+func (srv *Server) upsell(ids []int) (items []item, err error) {
+	popular, err := outil.Popular(srv.db, time.Now().AddDate(0, 0, -upsellDays),
+		*upsellFlag, ids)
+	if err != nil || len(popular) == 0 {
+		return nil, err
+	}
+	if items, err = srv.getItems(popular, []string{}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(items, func(a, b item) int {
+		return slices.Index(popular, a.ID) - slices.Index(popular, b.ID)
+	})
+	return items, nil
+}
+
+func (srv *Server) searchItems(q string) (items []item, err error) {
+	dbItems, err := iutil.Search(srv.db, q, searchSort)
+	if err != nil {
+		return nil, err
+	}
+	return srv.toItems(dbItems), nil
+}
+
+// pickLang picks the language of a page among those of the shop: that of
+// the lang parameter, or else the most preferred one of Accept-Language,
+// or else the language of the items.
+func (srv *Server) pickLang(r *http.Request) (lang string) {
+	offered := append([]string{srv.lang}, srv.langs...)
+	wanted := append([]string{r.FormValue("lang")},
+		acceptLangs(r.Header.Get("Accept-Language"))...)
+	// An exact match is better than one of the primary language alone.
+	for _, w := range wanted {
+		for _, o := range offered {
+			if w != "" && strings.EqualFold(w, o) {
+				return o
+			}
+		}
+		for _, o := range offered {
+			if w != "" && strings.EqualFold(primaryLang(w), primaryLang(o)) {
+				return o
+			}
+		}
+	}
+	return srv.lang
+}
+
+// acceptLangs returns the languages of an Accept-Language header, most
+// preferred first, leaving out * and those of weight 0.
+func acceptLangs(hdr string) (langs []string) {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var ls []lang
+	for _, v := range strings.Split(hdr, ",") {
+		tag, params, _ := strings.Cut(v, ";")
+		l := lang{tag: strings.TrimSpace(tag), q: 1}
+		if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(qs, 64); err == nil {
+				l.q = q
+			}
+		}
+		if l.tag != "" && l.tag != "*" && l.q > 0 {
+			ls = append(ls, l)
+		}
+	}
+	slices.SortStableFunc(ls, func(a, b lang) int {
+		return cmp.Compare(b.q, a.q)
+	})
+	for _, l := range ls {
+		langs = append(langs, l.tag)
+	}
+	return langs
+}
+
+// primaryLang returns the primary language of a language tag, e.g. en of
+// en-GB.
+func primaryLang(tag string) (lang string) {
+	lang, _, _ = strings.Cut(tag, "-")
+	return lang
+}
+
+// translate puts the name and description of it in lang, where they are
+// translated.
+func (it *item) translate(lang string) {
+	t := it.Translations[lang]
+	if t.Name != "" {
+		it.Name = t.Name
+	}
+	if t.Descr != "" {
+		it.Descr = t.Descr
+	}
+}
+
+// exRate is an exchange rate: what one unit of the shop's currency is
+// worth in Cur.
+type exRate struct {
+	Cur  iutil.Currency
+	Rate float64
+}
+
+// parseRate parses an exchange rate given as CODE=RATE, for a currency
+// with two decimals, or as CODE/DECIMALS=RATE.
+func parseRate(s string) (x exRate, err error) {
+	cur, r, ok := strings.Cut(s, "=")
+	code, minor, hasMinor := strings.Cut(strings.TrimSpace(cur), "/")
+	x.Cur = iutil.Currency{Code: code, Minor: 2}
+	if hasMinor {
+		x.Cur.Minor, err = strconv.Atoi(minor)
+	}
+	if err == nil && ok {
+		x.Rate, err = strconv.ParseFloat(strings.TrimSpace(r), 64)
+	}
+	if !ok || err != nil || x.Cur.Code == "" || x.Cur.Minor < 0 || x.Rate <= 0 {
+		return x, errors.New("invalid exchange rate: " + s)
+	}
+	return x, nil
+}
+
+// approx returns the currency asked for by the currency parameter, if the
+// shop has a rate for it, and a function giving approximate prices in it.
+// Otherwise the currency is "" and the function returns "".
+func (srv *Server) approx(r *http.Request) (code string, f func(n int) string) {
+	want := r.FormValue("currency")
+	for i := range srv.rates {
+		x := &srv.rates[i]
+		if strings.EqualFold(want, x.Cur.Code) {
+			return x.Cur.Code, func(n int) string {
+				return "≈ " + x.Cur.Format(srv.cur.Convert(n, &x.Cur, x.Rate))
+			}
+		}
+	}
+	return "", func(n int) string { return "" }
+}
+
+// hours are daily opening hours, in minutes since midnight.  Closing may
+// be after midnight, before opening.  The shop is always open if both are
+// the same.
+type hours struct {
+	open, close int
+}
+
+// parseHours parses opening hours given as HH:MM-HH:MM.  Empty hours are
+// always open.
+func parseHours(s string) (h hours, err error) {
+	if s == "" {
+		return h, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	t1, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	t2, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if !ok || err1 != nil || err2 != nil {
+		return h, errors.New("invalid opening hours: " + s)
+	}
+	return hours{t1.Hour()*60 + t1.Minute(), t2.Hour()*60 + t2.Minute()}, nil
+}
+
+// isOpen tells whether t, in timeLoc, is within h.
+func (h hours) isOpen(t time.Time) (ok bool) {
+	t = t.In(timeLoc)
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case h.open == h.close:
+		return true
+	case h.open < h.close:
+		return m >= h.open && m < h.close
+	default:
+		return m >= h.open || m < h.close
+	}
+}
+
+func (h hours) String() (s string) {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", h.open/60, h.open%60,
+		h.close/60, h.close%60)
+}
+
+// allNotes returns the notes shown under the menu: those following from
+// the rules of srv and c, then those of c.
+func (srv *Server) allNotes(c *shopConf) (notes []string) {
+	if srv.hours.open != srv.hours.close {
+		notes = append(notes, "Open daily "+srv.hours.String()+".")
+	}
+	if c.minOrder > 0 {
+		notes = append(notes, "Minimum order "+srv.cur.Format(c.minOrder)+".")
+	}
+	if c.freeDelivery > 0 {
+		notes = append(notes, "Free delivery from "+srv.cur.Format(c.freeDelivery)+".")
+	}
+	return append(notes, c.notes...)
+}
+
+// shopConf is what of a shop may be changed in the admin area, where it
+// is stored as settings.
+type shopConf struct {
+	title        string
+	delivery     int
+	freeDelivery int // 0 if never
+	minOrder     int
+	notes        []string
+}
+
+// defaultConf returns the shopConf of srv as given by the flags, the
+// config file or the tenants file.
+func (srv *Server) defaultConf() (c *shopConf) {
+	return srv.defaults.Load()
+}
+
+// setDefaults sets the default shopConf of srv from shop.
+func (srv *Server) setDefaults(shop Shop) (err error) {
+	c := &shopConf{title: shop.Title, notes: shop.Notes}
+	for _, p := range []struct {
+		name string
+		s    string
+		n    *int
+	}{
+		{"delivery", shop.Delivery, &c.delivery},
+		{"freedelivery", shop.FreeDelivery, &c.freeDelivery},
+		{"minorder", shop.MinOrder, &c.minOrder},
+	} {
+		if p.s == "" {
+			continue
+		}
+		if *p.n, err = srv.cur.Parse(p.s); err != nil {
+			return errors.New(p.name + ": " + err.Error())
+		}
+	}
+	srv.defaults.Store(c)
+	return nil
+}
+
+// shop returns the shopConf of srv as last read by loadConf, or else the
+// default one.
+func (srv *Server) shop() (c *shopConf) {
+	if c = srv.conf.Load(); c == nil {
+		c = srv.defaultConf()
+	}
+	return c
+}
+
+// loadConf reads the settings of the database over the default shopConf
+// of srv, and keeps the result for shop.  The caller must hold dbLock.
+func (srv *Server) loadConf() (c *shopConf, err error) {
+	s, err := sutil.Get(srv.db)
+	if err != nil {
+		return nil, err
+	}
+	d := srv.defaultConf()
+	c = &shopConf{
+		title:        s.String(sutil.Title, d.title),
+		delivery:     s.Int(sutil.Delivery, d.delivery),
+		freeDelivery: s.Int(sutil.FreeDelivery, d.freeDelivery),
+		minOrder:     s.Int(sutil.MinOrder, d.minOrder),
+		notes:        s.Lines(sutil.Notes, d.notes),
+	}
+	srv.conf.Store(c)
+	return c, nil
+}
+
+// settingFields are the fields of the settings form of the admin area.
+var settingFields = []struct {
+	Key   string
+	Label string
+	Lines bool // if a textarea of lines
+}{
+	{sutil.Title, "Title", false},
+	{sutil.Delivery, "Delivery fee", false},
+	{sutil.FreeDelivery, "Free delivery from", false},
+	{sutil.MinOrder, "Minimum order", false},
+	{sutil.Notes, "Notes under the menu", true},
+}
+
+// setting is a field of the settings form, with the setting stored, if
+// any, and what it defaults to.
+type setting struct {
+	Key     string
+	Label   string
+	Lines   bool
+	Value   string
+	Default string
+	Error   string
+}
+
+// settingsForm fills in the settings form from the stored settings, or
+// else from form, if given.
+func (srv *Server) settingsForm(form url.Values, fe fieldErrors) (fields []setting,
+	err error) {
+
+	s, err := sutil.Get(srv.db)
+	if err != nil {
+		return nil, err
+	}
+	d := srv.defaultConf()
+	amount := func(key string, def int) (v string, dv string) {
+		if _, ok := s[key]; ok {
+			v = srv.cur.String(s.Int(key, 0))
+		}
+		return v, srv.cur.String(def)
+	}
+	for _, f := range settingFields {
+		st := setting{Key: f.Key, Label: f.Label, Lines: f.Lines, Error: fe[f.Key]}
+		switch f.Key {
+		case sutil.Title:
+			st.Value, st.Default = s[f.Key], d.title
+		case sutil.Delivery:
+			st.Value, st.Default = amount(f.Key, d.delivery)
+		case sutil.FreeDelivery:
+			st.Value, st.Default = amount(f.Key, d.freeDelivery)
+		case sutil.MinOrder:
+			st.Value, st.Default = amount(f.Key, d.minOrder)
+		case sutil.Notes:
+			st.Value, st.Default = s[f.Key], strings.Join(d.notes, "\n")
+		}
+		if form != nil {
+			st.Value = form.Get(f.Key)
+		}
+		fields = append(fields, st)
+	}
+	return fields, nil
+}
+
+// setSettings stores the settings of the admin form, returning a message
+// of it.  An empty field removes the setting, leaving it to the flags
+// again.
+func (srv *Server) setSettings(w http.ResponseWriter, r *http.Request) (msg string, status int,
+	err error) {
+
+	fe := make(fieldErrors)
+	vals := make(map[string]string)
+	for _, f := range settingFields {
+		v := strings.TrimSpace(r.FormValue(f.Key))
+		switch {
+		case v == "":
+		case f.Key == sutil.Delivery || f.Key == sutil.FreeDelivery ||
+			f.Key == sutil.MinOrder:
+
+			n, err := srv.cur.Parse(v)
+			if err != nil {
+				fe[f.Key] = err.Error()
+				continue
+			}
+			v = strconv.Itoa(n)
+		case f.Lines:
+			var lines []string
+			for _, l := range strings.Split(v, "\n") {
+				if l = strings.TrimSpace(l); l != "" {
+					lines = append(lines, l)
+				}
+			}
+			v = strings.Join(lines, "\n")
+		}
+		vals[f.Key] = v
+	}
+	if len(fe) > 0 {
+		return "", http.StatusBadRequest, fe
+	}
+
+	tx, err := srv.db.Begin(context.Background())
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	defer tx.Rollback(context.Background())
+	for k, v := range vals {
+		if v == "" {
+			err = sutil.Del(tx, k)
+		} else {
+			err = sutil.Set(tx, k, v)
+		}
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	return "Settings saved.", http.StatusOK, nil
+}
+
+func (srv *Server) toItems(dbItems []iutil.Item) (items []item) {
+	for i := range dbItems {
+		var it item
+		p := &dbItems[i]
+		it.ID = *p.ID
+		it.Ord = i
+		it.Name = *p.Name
+		it.Price = srv.newPrice(iutil.Or(p.Price, 0))
+		it.VAT = iutil.Or(p.VAT, 0)
+		it.OwnMaxQty = iutil.Or(p.MaxQty, 0)
+		it.MaxQty = iutil.Or(p.MaxQty, *itemQtyFlag)
+		it.Updated = p.Updated
+		it.Translations = p.Translations
+		if p.SoldOut(time.Now()) {
+			it.SoldOut = true
+			it.SoldOutUntil = p.SoldOutUntil
+		}
+		it.Slug = iutil.Or(p.Slug, iutil.Slug(it.Name))
+		it.Descr = iutil.Or(p.Descr, "")
+		if p.Img.Name != nil {
+			it.Img = imgPath(*p.Img.Name)
+		}
+		for _, v := range p.Variants {
+			it.Variants = append(it.Variants, variant{
+				Label: v.Label,
+				Price: srv.newPrice(v.Price),
+			})
+		}
+		for _, m := range p.Modifiers {
+			mp := srv.newPrice(m.Price)
+			if m.Price >= 0 {
+				mp.Str = "+" + mp.Str
+				mp.Val = "+" + mp.Val
+			}
+			it.Modifiers = append(it.Modifiers, modifier{
+				Label: m.Label,
+				Price: mp,
+				Multi: m.Multi,
+			})
+		}
+
+		items = append(items, it)
+	}
+
+	return items
+}
+
+func (srv *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title     string
+		Logo      string
+		Currency  iutil.Currency
+		Message   string
+		AddErrors fieldErrors
+		Add       map[string]string // what was submitted to the add form
+		Settings  []setting
+		Sort      string
+		Sorts     []string
+		Langs     []string // the items may be translated to
+		Items     []item
+		Preview   string // of the order message
+		Stats     iutil.ItemStats
+		Users     []string
+	}{
+		Sorts:    []string{"id", "name", "price"},
+		Langs:    srv.langs,
+		Currency: srv.cur,
+	}
+
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	if code, err := srv.auth(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, "", code, "", err)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	setUser(w, user)
+
+	// Uploads are limited before parsing the form, which reads them.
+	uploading := false
+	if r.Method == http.MethodPost &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+
+		if !srv.acquireUpload(r.Context()) {
+			uploadBusy(w, r, user)
+			return
+		}
+		defer srv.releaseUpload()
+		uploading = true
+	}
+
+	if code, err := getForm(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, "", code, "", err)
+		return
+	}
+
+	if !uploading && r.FormValue("img_url") != "" {
+		if !srv.acquireUpload(r.Context()) {
+			uploadBusy(w, r, user)
+			return
+		}
+		defer srv.releaseUpload()
+	}
+
+	var msg string
+	var status int
+	var err error
+	if r.Method == http.MethodPost {
+		action := r.FormValue("action")
+		switch action {
+		case "branding":
+			status, err = srv.setBranding(w, r)
+		case "chpass":
+			status, err = srv.chpass(w, r, user)
+		case "imgdel":
+			status, err = srv.imgDel(w, r)
+		case "instock":
+			status, err = srv.soldOut(w, r, false)
+		case "itemadd":
+			status, err = srv.itemAdd(w, r)
+		case "itemdel":
+			msg, status, err = srv.itemDel(w, r)
+		case "itemmod":
+			status, err = srv.itemMod(w, r)
+		case "soldout":
+			status, err = srv.soldOut(w, r, true)
+		case "userdel":
+			msg, status, err = srv.userDel(w, r)
+		case "settings":
+			msg, status, err = srv.setSettings(w, r)
+		case "preview":
+			page.Preview, status, err = srv.orderPreview()
+		case "testsend":
+			page.Preview, msg, status, err = srv.testSend()
+		default:
+			status = http.StatusBadRequest
+			err = errors.New("bad action: " + action)
+		}
+	}
+	var fe fieldErrors
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			srv.logAndHandleDBError(w, r, user, err)
+			return
+		} else if !errors.As(err, &fe) && status != http.StatusOK {
+			logAndHandleError(w, r, user, status, "", err)
+			return
+		}
+		page.Message = err.Error()
+	} else {
+		page.Message = msg
+	}
+
+	conf, err := srv.loadConf()
+	if err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+	page.Title = conf.title + ": Admin Area"
+	var form url.Values // to refill the settings form with
+	if fe != nil && r.FormValue("action") == "settings" {
+		form = r.Form
+	}
+	if page.Settings, err = srv.settingsForm(form, fe); err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+
+	ord := srv.adminOrder(w, r)
+	page.Sort = ord.String()
+	dbItems, err := iutil.Get(srv.db, []int{}, []string{}, ord)
+	if err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+	page.Items = srv.toItems(dbItems)
+	if page.Stats, err = iutil.Stats(srv.db, time.Now().In(timeLoc)); err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+	if page.Users, err = putil.List(srv.db); err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+	if fe != nil {
+		logError(r, user, status, fe)
+		page.Message = "Please correct the fields below."
+		if r.FormValue("action") == "itemadd" {
+			page.AddErrors = fe
+			page.Add = make(map[string]string)
+			for _, k := range []string{"name", "descr", "price", "vat",
+				"maxqty", "img_url", "variants", "modifiers"} {
+
+				page.Add[k] = r.FormValue(k)
+			}
+		} else if id, _ := strconv.Atoi(r.FormValue("id")); id != 0 {
+			for i := range page.Items {
+				if page.Items[i].ID == id {
+					page.Items[i].Errors = fe
+				}
+			}
+		}
+	}
+	if page.Logo, err = srv.logoPath(); err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+
+	if fe != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err = srv.assets.Load().htmpls.ExecuteTemplate(w, "admin.htmpl", page); err != nil {
+		logAndHandleError(w, r, user, http.StatusInternalServerError, "", err)
+	}
+}
+
+// orderPreview renders the order message of a sample order of a few of
+// the items.
+func (srv *Server) orderPreview() (msg string, code int, err error) {
+	items, err := srv.getItems([]int{}, []string{})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if len(items) > 2 {
+		items = items[:2]
+	}
+	if len(items) == 0 {
+		items = []item{{Name: "Sample item", Price: srv.newPrice(1000)}}
+	}
+	sample := struct {
+		OrderID  int
+		Time     time.Time
+		Name     string
+		Contact  string
+		Address  string
+		Comments string
+		Items    []item
+		Delivery price
+		TipAmt   price
+		VAT      price
+		Net      price
+		Total    price
+	}{
+		OrderID:  1,
+		Time:     time.Now(),
+		Name:     "Jane <Doe> & Co",
+		Contact:  "+995 555 123 456",
+		Address:  "1 Sample St, Apt. \"2\"",
+		Comments: "Ring twice *please*",
+		Delivery: srv.newPrice(srv.shop().delivery),
+	}
+	total, vat := 0, 0
+	for i, it := range items {
+		it.Ord = i + 1
+		it.Num = i + 1
+		if len(it.Variants) > 0 {
+			it.Variant = it.Variants[0].Label
+			it.Price = it.Variants[0].Price
+		}
+		if len(it.Modifiers) > 0 {
+			it.Chosen = []string{it.Modifiers[0].Label}
+			it.Price = srv.newPrice(it.Price.Num + it.Modifiers[0].Price.Num)
+		}
+		it.Total = srv.newPrice(it.Price.Num * it.Num)
+		total += it.Total.Num
+		vat += iutil.VATOf(it.Total.Num, it.VAT)
+		sample.Items = append(sample.Items, it)
+	}
+	sample.TipAmt = srv.newPrice((total + 5) / 10)
+	total += sample.TipAmt.Num + sample.Delivery.Num
+	sample.VAT = srv.newPrice(vat)
+	sample.Net = srv.newPrice(total - vat)
+	sample.Total = srv.newPrice(total)
+
+	var buf bytes.Buffer
+	err = srv.assets.Load().tmpls.ExecuteTemplate(&buf, "order.tmpl", sample)
+	if err != nil {
+		return "", http.StatusOK, err
+	}
+	return srv.frame(buf.String()), http.StatusOK, nil
+}
+
+// testSend sends the order message of orderPreview to the telegram chat,
+// marked as a test, returning it and a message of the sending.
+func (srv *Server) testSend() (preview, msg string, code int, err error) {
+	if preview, code, err = srv.orderPreview(); err != nil {
+		return preview, "", code, err
+	}
+	if srv.tg == nil {
+		return preview, "", http.StatusOK, errors.New("Telegram is not configured.")
+	}
+	if err = srv.send(srv.tg, "TEST, not a real order\n\n"+preview, nil); err != nil {
+		return preview, "", http.StatusOK, errors.New("Sending failed: " + err.Error())
+	}
+	return preview, "Sent a test message.", http.StatusOK, nil
+}
+
+const sortCookie = "sort"
+
+// adminOrder returns the order of the items in the admin area, from the
+// sort parameter, which is remembered in a cookie, or else from the cookie,
+// or else -adminsort.
+func (srv *Server) adminOrder(w http.ResponseWriter, r *http.Request) (ord iutil.Order) {
+	if s := r.URL.Query().Get("sort"); s != "" {
+		if ord, err := iutil.ParseOrder(s); err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sortCookie,
+				Value:    s,
+				Path:     prefixed("/admin"),
+				MaxAge:   365 * 24 * 60 * 60,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			return ord
+		}
+	}
+	if c, err := r.Cookie(sortCookie); err == nil {
+		if ord, err := iutil.ParseOrder(c.Value); err == nil {
+			return ord
+		}
+	}
+	return adminSort
+}
+
+// webhookTimeout is how long sendWebhook waits for each attempt.
+const webhookTimeout = 10 * time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// sendWebhook posts o to the webhook URL, retrying a few times.  The body
+// is signed with HMAC-SHA256 in the X-Signature header if there is a key.
+func (srv *Server) sendWebhook(o *outil.Order) {
+	body, err := json.Marshal(o)
+	if err != nil {
+		errLog.Print("webhook: ", err)
+		return
+	}
+
+	try := func() (err error) {
+		req, err := http.NewRequest(http.MethodPost, srv.webhook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if srv.webhookKey != nil {
+			h := hmac.New(sha256.New, srv.webhookKey)
+			h.Write(body)
+			req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(h.Sum(nil)))
+		}
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+
+	for i, wait := 0, time.Second; i < 5; i, wait = i+1, wait*4 {
+		if err = try(); err == nil {
+			return
+		}
+		errLog.Printf("webhook for order %v (attempt %v): %v", o.ID, i+1, err)
+		time.Sleep(wait)
+	}
+	errLog.Printf("webhook for order %v: giving up", o.ID)
+}
+
+// addrChecker checks delivery addresses.  checkAddr returns addr as it
+// is to be kept, possibly normalized.  It fails with an addrError if addr
+// is no good, and with another error if it can't tell.
+type addrChecker interface {
+	checkAddr(ctx context.Context, addr string) (norm string, err error)
+}
+
+// addrError is why an address is no good, to be shown to the customer.
+type addrError string
+
+func (e addrError) Error() string {
+	return string(e)
+}
+
+// noAddrCheck takes any address as it is.
+type noAddrCheck struct{}
+
+func (noAddrCheck) checkAddr(ctx context.Context, addr string) (norm string, err error) {
+	return addr, nil
+}
+
+// addrCheckTimeout is how long httpAddrCheck waits for the service.
+const addrCheckTimeout = 5 * time.Second
+
+// httpAddrCheck checks addresses with a service at url, which is POSTed
+// {"address": addr} and answers with {"ok": bool, "address": norm,
+// "message": why not ok}.  An empty norm keeps addr as it is.
+type httpAddrCheck struct {
+	url string
+}
+
+func (c httpAddrCheck) checkAddr(ctx context.Context, addr string) (norm string, err error) {
+	body, err := json.Marshal(struct {
+		Address string `json:"address"`
+	}{addr})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, addrCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url,
+		bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", errors.New(resp.Status)
+	}
+
+	var res struct {
+		OK      bool   `json:"ok"`
+		Address string `json:"address"`
+		Message string `json:"message"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&res); err != nil {
+		return "", err
+	}
+	if !res.OK {
+		if res.Message == "" {
+			res.Message = "address not found"
+		}
+		return "", addrError(res.Message)
+	}
+	if res.Address == "" {
+		return addr, nil
+	}
+	return res.Address, nil
+}
+
+// checkAddr checks addr with the address checker of srv.  If the checker
+// fails, addr is taken as it is, unless -addrcheckstrict is given.
+func (srv *Server) checkAddr(r *http.Request, addr string) (norm string, err error) {
+	norm, err = srv.addrCheck.checkAddr(r.Context(), addr)
+	var ae addrError
+	if err != nil && !errors.As(err, &ae) {
+		errLog.Print("address check: ", err)
+		if !*addrCheckStrictFlag {
+			return addr, nil
+		}
+		return "", addrError("can't check the address now, please try later")
+	}
+	return norm, err
+}
+
+const (
+	honeypotField = "website"  // of the order form, left empty by people
+	formTimeField = "formtime" // of the order form, for -minfill
+)
+
+// formToken returns the signed time t for formTimeField.
+func (srv *Server) formToken(t time.Time) (tok string) {
+	v := strconv.FormatInt(t.Unix(), 10)
+	h := hmac.New(sha256.New, srv.cookieKey)
+	h.Write([]byte(formTimeField + ":" + v))
+	return v + "~" + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// formMaxAge is how long a formTimeField stays valid, so that a token
+// taken once can't be replayed by a bot forever.
+const formMaxAge = 24 * time.Hour
+
+// formAge returns how long ago the order form submitted with r was
+// shown, if it has a valid formTimeField no older than formMaxAge.
+func (srv *Server) formAge(r *http.Request) (d time.Duration, ok bool) {
+	tok := r.FormValue(formTimeField)
+	v, _, _ := strings.Cut(tok, "~")
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || !hmac.Equal([]byte(tok), []byte(srv.formToken(time.Unix(sec, 0)))) {
+		return 0, false
+	}
+	if d = time.Since(time.Unix(sec, 0)); d < 0 || d > formMaxAge {
+		return 0, false
+	}
+	return d, true
+}
+
+const cartCookie = "cart"
+
+func (srv *Server) cartMAC(v string) (mac string) {
+	h := hmac.New(sha256.New, srv.cookieKey)
+	h.Write([]byte(v))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// readCart returns the item quantities stored in the cart cookie, or nil
+// if there is no valid one.
+func (srv *Server) readCart(r *http.Request) (ordered map[int]int) {
+	c, err := r.Cookie(cartCookie)
+	if err != nil {
+		return nil
+	}
+	v, mac, ok := strings.Cut(c.Value, "~")
+	if !ok || !hmac.Equal([]byte(mac), []byte(srv.cartMAC(v))) {
+		return nil
+	}
+
+	ordered = make(map[int]int)
+	for _, e := range strings.Split(v, ".") {
+		k, n, _ := strings.Cut(e, ":")
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		if ordered[id], err = strconv.Atoi(n); err != nil {
+			delete(ordered, id)
+		}
+	}
+	return ordered
+}
+
+// setCart stores the item quantities in a signed cookie, or removes the
+// cookie if there are none.
+func (srv *Server) setCart(w http.ResponseWriter, ordered map[int]int) {
+	c := http.Cookie{
+		Name:     cartCookie,
+		Path:     prefixed("/"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if len(ordered) == 0 {
+		c.MaxAge = -1
+	} else {
+		var l []string
+		for id, n := range ordered {
+			l = append(l, fmt.Sprintf("%v:%v", id, n))
+		}
+		v := strings.Join(l, ".")
+		c.Value = v + "~" + srv.cartMAC(v)
+		c.MaxAge = 7 * 24 * 60 * 60
+	}
+	http.SetCookie(w, &c)
+}
+
+// stoi parses s as a decimal number without sign or leading zeros.
+func stoi(s string) (n int, err error) {
+	if !intRE.MatchString(s) {
+		return 0, errors.New("bad number: " + s)
+	}
+	return strconv.Atoi(s)
+}
+
+// parseQty parses an ordered quantity.  An empty quantity is 0.  It is
+// checked against the item's MaxQty once the item is known.
+func parseQty(s string) (n int, err error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	if n, err = stoi(s); err != nil {
+		return 0, errors.New("bad quantity: " + s)
+	}
+	return n, nil
+}
+
+// parseMaxQty parses the most one may order of an item.  An empty or 0
+// one is the default of -itemqty.
+func parseMaxQty(s string) (n int, err error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	if n, err = stoi(s); err != nil {
+		return 0, errors.New("invalid quantity")
+	}
+	return n, nil
+}
+
+func (srv *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	var total, vat int
+	var err error
+	var ids []int
+	ordered := make(map[int]int)
+	variants := make(map[int]string)
+	mods := make(map[int][]string)
+
+	const (
+		actCheckout = iota
+		actOrder
 	)
 
-	page := struct {
-		Checkout bool
-		Ordered  bool
+	page := struct {
+		Checkout bool
+		Ordered  bool
+		OrderID  int
+		Time     time.Time // of the order
+		Cancel   bool      // whether the order may be canceled
+
+		Title    string
+		Logo     string
+		Meta     meta
+		Currency iutil.Currency
+		Delivery price
+		TipAmt   price
+		Total    price
+		VAT      price   // included in Total
+		Net      price   // Total without VAT
+		Tips     strList // suggested
+		Notes    []string
+		Items    []item
+		Query    string
+		Cart     []item // ordered items hidden by the search
+		Upsell   []item // suggested at checkout
+
+		Name     string
+		Contact  string
+		Address  string
+		Comments string
+		Tip      string // an amount or a percentage
+		Errors   fieldErrors
+
+		Honeypot bool   // if the order form has one
+		FormTime string // signed time the order form was shown, if -minfill
+
+		Lang  string   // of the page
+		Langs []string // to choose from
+
+		ApproxCur  string             // of the approximate prices, if any
+		Approx     func(n int) string // approximate price in ApproxCur
+		Currencies []string           // to choose from, the shop's first
+	}{
+		Currency: srv.cur,
+	}
+	page.Tips.Set(*tipsFlag)
+
+	intErr := func(err error) {
+		srv.logAndHandleDBError(w, r, "", err)
+	}
+
+	if code, err := getForm(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, "", code, "", err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		action := r.FormValue("action")
+		switch action {
+		case "order":
+			page.Ordered = true
+			fallthrough
+		case "checkout":
+			page.Checkout = true
+		case "search":
+		default:
+			logAndHandleError(w, r, "", http.StatusBadRequest, "",
+				errors.New("bad action: "+action))
+			return
+		}
+
+		for k := range r.PostForm {
+			switch k {
+			case "name":
+				page.Name = r.FormValue(k)
+				continue
+			case "contact":
+				page.Contact = r.FormValue(k)
+				continue
+			case "address":
+				page.Address = r.FormValue(k)
+				continue
+			case "comments":
+				page.Comments = r.FormValue(k)
+				continue
+			case "tip":
+				page.Tip = strings.TrimSpace(r.FormValue(k))
+				continue
+			case "q":
+				continue
+			}
+
+			if v, ok := strings.CutPrefix(k, "variant_"); ok {
+				if id, err := strconv.Atoi(v); err == nil {
+					variants[id] = r.FormValue(k)
+				}
+				continue
+			}
+			if v, ok := strings.CutPrefix(k, "mod_"); ok {
+				if id, err := strconv.Atoi(v); err == nil {
+					mods[id] = r.PostForm[k]
+				}
+				continue
+			}
+
+			var id, n int
+			if v, ok := strings.CutPrefix(k, "item["); ok {
+				v, ok = strings.CutSuffix(v, "]")
+				id, err = strconv.Atoi(v)
+				if !ok || err != nil || id <= 0 || strconv.Itoa(id) != v {
+					logAndHandleError(w, r, "", http.StatusBadRequest, "",
+						errors.New("bad item: "+k))
+					return
+				}
+				if n, err = parseQty(r.FormValue(k)); err != nil {
+					logAndHandleError(w, r, "", http.StatusBadRequest, "", err)
+					return
+				}
+				if n == 0 {
+					continue
+				}
+			} else {
+				// Bare item ids as keys, as sent by forms of older
+				// versions.  To be removed in the next release.  Only
+				// keys that are nothing but an id count, lest other
+				// fields be taken for items.
+				if id, err = strconv.Atoi(k); err != nil || id <= 0 ||
+					strconv.Itoa(id) != k {
+					continue
+				}
+				if n, err = stoi(r.FormValue(k)); n <= 0 || err != nil {
+					continue
+				}
+			}
+			if _, ok := ordered[id]; !ok {
+				ids = append(ids, id)
+			}
+			ordered[id] = n
+		}
+
+		// An item suggested at checkout, added by its button.
+		if action == "checkout" {
+			if id, err := stoi(r.URL.Query().Get("add")); err == nil && id > 0 {
+				if _, ok := ordered[id]; !ok {
+					ids = append(ids, id)
+				}
+				ordered[id]++
+			}
+		}
+
+		qty := 0
+		for _, n := range ordered {
+			qty += n
+		}
+		if len(ordered) > *maxItemsFlag {
+			logAndHandleError(w, r, "", http.StatusBadRequest,
+				fmt.Sprintf("too many different items (max %v)", *maxItemsFlag), nil)
+			return
+		}
+		if qty > *maxQtyFlag {
+			logAndHandleError(w, r, "", http.StatusBadRequest,
+				fmt.Sprintf("too many items in total (max %v)", *maxQtyFlag), nil)
+			return
+		}
+
+		// Without the client details, go back to the menu to fill them in.
+		if page.Checkout {
+			if *honeypotFlag && r.FormValue(honeypotField) != "" {
+				logAndHandleError(w, r, "", http.StatusBadRequest, "",
+					errors.New("honeypot filled in"))
+				return
+			}
+
+			// JSON requests come from API clients, not the order
+			// form, so they carry no form time.
+			errs := make(fieldErrors)
+			if *minFillFlag > 0 &&
+				mediaType(r.Header.Get("Content-Type")) != "application/json" {
+
+				if d, ok := srv.formAge(r); !ok || d < *minFillFlag {
+					errs["order"] = "please check your order and try again"
+				}
+			}
+			if strings.TrimSpace(page.Name) == "" {
+				errs["name"] = "required"
+			}
+			if strings.TrimSpace(page.Contact) == "" {
+				errs["contact"] = "required"
+			}
+			if strings.TrimSpace(page.Address) == "" {
+				errs["address"] = "required"
+			} else if addr, err := srv.checkAddr(r, page.Address); err != nil {
+				errs["address"] = err.Error()
+			} else {
+				page.Address = addr
+			}
+			if _, _, err := srv.parseTip(page.Tip); err != nil {
+				errs["tip"] = err.Error()
+			}
+			if !srv.hours.isOpen(time.Now()) {
+				errs["order"] = "closed now, open daily " + srv.hours.String()
+			}
+			if len(errs) > 0 {
+				page.Checkout = false
+				page.Ordered = false
+				page.Errors = errs
+			}
+		}
+	} else if cart := srv.readCart(r); cart != nil {
+		for id, n := range cart {
+			ids = append(ids, id)
+			ordered[id] = n
+		}
+	}
+
+	// The time the order form was first shown is carried to checkout.
+	page.Honeypot = *honeypotFlag
+	if *minFillFlag > 0 {
+		if page.Checkout {
+			page.FormTime = r.FormValue(formTimeField)
+		} else {
+			page.FormTime = srv.formToken(time.Now())
+		}
+	}
+
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	conf, err := srv.loadConf()
+	if err != nil {
+		intErr(err)
+		return
+	}
+	page.Title = conf.title
+	page.Delivery = srv.newPrice(conf.delivery)
+	page.Notes = srv.allNotes(conf)
+
+	if page.Logo, err = srv.logoPath(); err != nil {
+		intErr(err)
+		return
+	}
+
+	page.Query = strings.TrimSpace(r.FormValue("q"))
+	switch {
+	case page.Checkout:
+		page.Items, err = srv.getItems(ids, []string{})
+	case page.Query != "":
+		page.Items, err = srv.searchItems(page.Query)
+	default:
+		page.Items, err = srv.getItems([]int{}, []string{})
+	}
+	if err != nil {
+		intErr(err)
+		return
+	}
+	page.Meta = shopMeta(r, page.Title, page.Logo, page.Items)
+
+	if !page.Checkout {
+		shown := make(map[int]bool)
+		for i := range page.Items {
+			page.Items[i].Num = ordered[page.Items[i].ID]
+			shown[page.Items[i].ID] = true
+		}
+		for _, id := range ids {
+			if !shown[id] {
+				page.Cart = append(page.Cart, item{ID: id, Num: ordered[id]})
+			}
+		}
+	}
+
+	if page.Checkout {
+		var soldOut []string
+		lines := 0
+		for i := range page.Items {
+			p := &page.Items[i]
+			p.Num = ordered[p.ID]
+			if p.SoldOut {
+				if p.Num > 0 {
+					soldOut = append(soldOut, p.Name)
+				}
+				p.Num = 0
+			}
+			if p.Num > 0 {
+				lines++
+			}
+			if len(p.Variants) > 0 {
+				v := p.Variants[0]
+				for _, pv := range p.Variants {
+					if pv.Label == variants[p.ID] {
+						v = pv
+						break
+					}
+				}
+				p.Variant = v.Label
+				p.Price = v.Price
+			}
+			single := false
+			for _, m := range p.Modifiers {
+				if !slices.Contains(mods[p.ID], m.Label) || (!m.Multi && single) {
+					continue
+				}
+				single = single || !m.Multi
+				p.Chosen = append(p.Chosen, m.Label)
+				p.Price.Num += m.Price.Num
+			}
+			if len(p.Chosen) > 0 {
+				p.Price = srv.newPrice(p.Price.Num)
+			}
+			if p.Num > p.MaxQty {
+				page.Ordered = false
+				if page.Errors == nil {
+					page.Errors = make(fieldErrors)
+				}
+				page.Errors[fmt.Sprintf("item[%v]", p.ID)] =
+					fmt.Sprintf("at most %v per order", p.MaxQty)
+			}
+			p.Total = srv.newPrice(p.Price.Num * p.Num)
+			p.VATAmt = srv.newPrice(iutil.VATOf(p.Total.Num, p.VAT))
+			total += p.Total.Num
+			vat += p.VATAmt.Num
+		}
+		if total < conf.minOrder {
+			page.Ordered = false
+			if page.Errors == nil {
+				page.Errors = make(fieldErrors)
+			}
+			page.Errors["order"] = "the minimum order is " + srv.cur.Format(conf.minOrder)
+		}
+		// Sold-out items are to be taken out first, whatever else is wrong.
+		if len(soldOut) > 0 {
+			page.Ordered = false
+			if page.Errors == nil {
+				page.Errors = make(fieldErrors)
+			}
+			page.Errors["order"] = "sold out, please take out of your order: " +
+				strings.Join(soldOut, ", ")
+		} else if lines == 0 && page.Ordered {
+			page.Ordered = false
+			if page.Errors == nil {
+				page.Errors = make(fieldErrors)
+			}
+			page.Errors["order"] = "the order is empty"
+		}
+		if conf.freeDelivery > 0 && total >= conf.freeDelivery {
+			page.Delivery = srv.newPrice(0)
+		}
+		pct, tip, _ := srv.parseTip(page.Tip)
+		if pct > 0 {
+			tip = (total*pct + 50) / 100
+		}
+		page.TipAmt = srv.newPrice(tip)
+		total += tip
+		total += page.Delivery.Num
+		page.Total = srv.newPrice(total)
+		page.VAT = srv.newPrice(vat)
+		page.Net = srv.newPrice(total - vat)
+
+		if !page.Ordered && *upsellFlag > 0 {
+			if page.Upsell, err = srv.upsell(ids); err != nil {
+				intErr(err)
+				return
+			}
+		}
+
+		if page.Ordered {
+			o := outil.Order{
+				Name:     page.Name,
+				Contact:  page.Contact,
+				Address:  page.Address,
+				Comments: page.Comments,
+				Delivery: page.Delivery.Num,
+				Tip:      page.TipAmt.Num,
+				VAT:      page.VAT.Num,
+				Total:    page.Total.Num,
+			}
+			for _, p := range page.Items {
+				if p.Num > 0 {
+					o.Lines = append(o.Lines, outil.Line{
+						ItemID:    p.ID,
+						Name:      p.Name,
+						Variant:   p.Variant,
+						Modifiers: p.Chosen,
+						Price:     p.Price.Num,
+						Num:       p.Num,
+						VAT:       p.VATAmt.Num,
+					})
+				}
+			}
+			if err = outil.Add(srv.db, &o); err != nil {
+				intErr(err)
+				return
+			}
+			page.OrderID = o.ID
+			page.Time = o.Time
+			page.Cancel = *cancelWindowFlag > 0
+
+			if srv.webhook != "" {
+				go srv.sendWebhook(&o)
+			}
+
+			var buf bytes.Buffer
+			srv.assets.Load().tmpls.ExecuteTemplate(&buf, "order.tmpl", page)
+			srv.notifyButtons(buf.String(), srv.orderButtons(o.ID))
+		}
+	}
+
+	// Only now, as an order may still be refused, e.g. if below minOrder.
+	if r.Method == http.MethodPost {
+		if page.Ordered {
+			srv.setCart(w, nil)
+		} else {
+			srv.setCart(w, ordered)
+		}
+	}
+
+	// Only now, so that the order keeps the names in the shop's language.
+	page.Lang = srv.pickLang(r)
+	page.Langs = append([]string{srv.lang}, srv.langs...)
+	for i := range page.Items {
+		page.Items[i].translate(page.Lang)
+	}
+	for i := range page.Upsell {
+		page.Upsell[i].translate(page.Lang)
+	}
+	page.ApproxCur, page.Approx = srv.approx(r)
+	page.Currencies = []string{srv.cur.Code}
+	for _, x := range srv.rates {
+		page.Currencies = append(page.Currencies, x.Cur.Code)
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	if page.Errors != nil {
+		logError(r, "", http.StatusBadRequest, page.Errors)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err = srv.assets.Load().htmpls.ExecuteTemplate(w, "root.htmpl", page); err != nil {
+		intErr(err)
+		return
+	}
+}
+
+// parseTip parses a tip given either as an amount or as a percentage of the
+// items' total, e.g. 2.50 or 10%.  No tip is 0.
+func (srv *Server) parseTip(s string) (pct, amount int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if v, ok := strings.CutSuffix(s, "%"); ok {
+		pct, err = strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || pct < 0 || pct > 100 {
+			return 0, 0, errors.New("invalid percentage")
+		}
+		return pct, 0, nil
+	}
+	if amount, err = srv.cur.Parse(s); err != nil {
+		return 0, 0, errors.New("invalid amount")
+	}
+	return 0, amount, nil
+}
+
+// meta is what the meta tags for link previews are made of.
+type meta struct {
+	Title string
+	Descr string
+	Image string // absolute URL
+	URL   string
+}
+
+// shopMeta makes the meta tags of the menu.  The image defaults to the
+// logo, then to the first item with an image.
+func shopMeta(r *http.Request, title, logo string, items []item) (m meta) {
+	base := baseURL(r)
+	m = meta{
+		Title: *ogTitleFlag,
+		Descr: *ogDescrFlag,
+		Image: *ogImageFlag,
+		URL:   base + prefixed("/"),
+	}
+	if m.Title == "" {
+		m.Title = title
+	}
+	if m.Image == "" && logo != "" {
+		m.Image = base + logo
+	}
+	for i := 0; m.Image == "" && i < len(items); i++ {
+		if items[i].Img != "" {
+			m.Image = base + items[i].Img
+		}
+	}
+	return m
+}
+
+// handleItem shows a single item, found by its ID or slug.
+func (srv *Server) handleItem(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Title    string
+		Logo     string
+		Meta     meta
+		Currency iutil.Currency
+		Item     item
+		Lang     string
+		Approx   func(n int) string
+	}{
+		Currency: srv.cur,
+		Lang:     srv.pickLang(r),
+	}
+	_, page.Approx = srv.approx(r)
+
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	var items []item
+	key := r.PathValue("key")
+	id, err := strconv.Atoi(key)
+	if err == nil {
+		items, err = srv.getItems([]int{id}, []string{})
+	} else {
+		items, err = srv.getSlug(key)
+	}
+	if err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	// Sold-out items can't be ordered, so they have no page either.
+	if len(items) == 0 || items[0].SoldOut {
+		srv.handleNotFound(w, r)
+		return
+	}
+	page.Item = items[0]
+	page.Item.translate(page.Lang)
+	w.Header().Add("Vary", "Accept-Language")
+	page.Title = page.Item.Name + " - " + srv.shop().title
+
+	if page.Logo, err = srv.logoPath(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+
+	page.Meta = meta{
+		Title: page.Item.Name,
+		Descr: page.Item.Descr,
+		URL:   baseURL(r) + prefixed("/item/"+url.PathEscape(page.Item.Slug)),
+	}
+	if page.Item.Img != "" {
+		page.Meta.Image = baseURL(r) + page.Item.Img
+	} else {
+		page.Meta.Image = shopMeta(r, "", page.Logo, nil).Image
+	}
+
+	if err = srv.assets.Load().htmpls.ExecuteTemplate(w, "item.htmpl", page); err != nil {
+		logAndHandleError(w, r, "", http.StatusInternalServerError, "", err)
+	}
+}
+
+// allowedMethods returns the methods with which the path of r has a route
+// in mux other than the catch-all.
+func allowedMethods(mux *http.ServeMux, r *http.Request) (allow []string) {
+	for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodPost,
+		http.MethodDelete} {
+
+		if m == r.Method {
+			continue
+		}
+		rm := r.Clone(r.Context())
+		rm.Method = m
+		if _, pattern := mux.Handler(rm); pattern != "/" && pattern != "" {
+			allow = append(allow, m)
+		}
+	}
+	return allow
+}
+
+// handleNotFound responds to paths of no page: with JSON to the API and
+// to clients preferring it, and else with a page linking to the menu.
+func (srv *Server) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") ||
+		(accepts(r, "application/json") && !accepts(r, "text/html")) {
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"error":"not found"}`+"\n")
+		return
+	}
+
+	page := struct {
+		Title string
+		Lang  string
+	}{
+		Title: srv.shop().title,
+		Lang:  srv.pickLang(r),
+	}
+	var buf bytes.Buffer
+	err := srv.assets.Load().htmpls.ExecuteTemplate(&buf, "notfound.htmpl", page)
+	if err != nil {
+		// The page may be missing from -tmpldir.
+		handleError(w, r, "", http.StatusNotFound, "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(buf.Bytes())
+}
+
+func (srv *Server) handleAPIItems(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+
+	if code, err := srv.apiAuth(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, "", code, "", err)
+		return
+	}
+
+	if s := r.PathValue("id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			handleError(w, r, "", http.StatusNotFound, "")
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	items, err := srv.getItems(ids, []string{})
+	if err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+
+	var v any = items
+	if len(ids) > 0 {
+		if len(items) == 0 {
+			handleError(w, r, "", http.StatusNotFound, "")
+			return
+		}
+		v = items[0]
+	} else if items == nil {
+		v = []item{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// baseURL returns the public scheme and host of the shop, to which its
+// paths are appended.
+func baseURL(r *http.Request) (u string) {
+	if *baseURLFlag != "" {
+		return strings.TrimSuffix(*baseURLFlag, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func handleRobots(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	b.WriteString("User-agent: *\n")
+	for _, p := range robotsAllow {
+		b.WriteString("Allow: " + prefixed(p) + "\n")
+	}
+	for _, p := range append(strList{"/admin"}, robotsDisallow...) {
+		b.WriteString("Disallow: " + prefixed(p) + "\n")
+	}
+	b.WriteString("\nSitemap: " + baseURL(r) + prefixed("/sitemap.xml") + "\n")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func (srv *Server) handleSitemap(w http.ResponseWriter, r *http.Request) {
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
 
-		Title    string
-		Currency string
-		Delivery price
-		Total    string
-		Notes    []string
-		Items    []item
+	items, err := srv.getItems([]int{}, []string{})
+	if err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
 
-		Name     string
-		Contact  string
-		Address  string
-		Comments string
+	var last time.Time
+	for _, it := range items {
+		if it.Updated.After(last) {
+			last = it.Updated
+		}
+	}
+	root := sitemapURL{Loc: baseURL(r) + prefixed("/")}
+	if !last.IsZero() {
+		root.LastMod = last.UTC().Format(time.DateOnly)
+	}
+
+	urlset := struct {
+		XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+		URLs    []sitemapURL `xml:"url"`
 	}{
-		Title:    "Rock Buffet",
-		Currency: "GEL",
-		Delivery: price{Num: 500, Str: "5.00"},
-		Notes:    []string{"Diameter 30 cm", "Delivery 5 GEL"},
+		URLs: []sitemapURL{root},
+	}
+	for _, it := range items {
+		u := sitemapURL{Loc: baseURL(r) + prefixed("/item/"+url.PathEscape(it.Slug))}
+		if !it.Updated.IsZero() {
+			u.LastMod = it.Updated.UTC().Format(time.DateOnly)
+		}
+		urlset.URLs = append(urlset.URLs, u)
 	}
 
-	intErr := func(err error) {
-		logAndHandleError(w, r, "", http.StatusInternalServerError, "", err)
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(urlset)
+}
+
+// handleImg serves the images of srv only.
+func (srv *Server) handleImg(w http.ResponseWriter, r *http.Request) {
+	p := r.PathValue("path")
+	if (srv.imgDir != "" && !strings.HasPrefix(p, srv.imgDir+"/")) ||
+		strings.HasSuffix(p, iutil.PartSuffix) || hasDotfile(p) {
+
+		handleError(w, r, "", http.StatusNotFound, "")
+		return
 	}
 
-	if code, err := getForm(w, r); code != http.StatusOK {
+	// Serve the preferred alternative format that the client accepts.
+	file := util.ImgPath(p)
+	if len(iutil.ImgConverters) > 0 {
+		w.Header().Add("Vary", "Accept")
+		for _, f := range iutil.ImgFormats {
+			if _, ok := iutil.ImgConverters[f]; !ok || !accepts(r, "image/"+f) {
+				continue
+			}
+			if _, err := os.Stat(file + "." + f); err == nil {
+				w.Header().Set("Content-Type", "image/"+f)
+				file += "." + f
+				break
+			}
+		}
+	}
+	http.ServeFile(w, r, file)
+}
+
+// hasDotfile reports whether any element of the slash-separated path p
+// starts with a dot, as does the lock of the image directory.
+func hasDotfile(p string) (ok bool) {
+	for _, e := range strings.Split(p, "/") {
+		if strings.HasPrefix(e, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether the Accept header of r accepts the media type
+// typ, which must be listed explicitly.
+func accepts(r *http.Request, typ string) (ok bool) {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(v)
+		if err != nil || mt != typ {
+			continue
+		}
+		q, err := strconv.ParseFloat(params["q"], 64)
+		return err != nil || q > 0
+	}
+	return false
+}
+
+// handleLive tells that the process is up.
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// handleReady tells whether srv can serve requests, i.e. whether the
+// database is up, as last seen by superviseDB.
+func (srv *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !srv.dbUp.Load() {
+		http.Error(w, errDBDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// handleImgDel removes an image from the item that has it.
+func (srv *Server) handleImgDel(w http.ResponseWriter, r *http.Request) {
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	if code, err := srv.auth(w, r); code != http.StatusOK {
 		logAndHandleError(w, r, "", code, "", err)
 		return
 	}
+	user, _, _ := r.BasicAuth()
+	setUser(w, user)
 
-	if r.Method == http.MethodPost {
-		action := r.FormValue("action")
-		switch action {
-		case "order":
-			page.Ordered = true
-			fallthrough
-		case "checkout":
-			page.Checkout = true
-		default:
-			logAndHandleError(w, r, "", http.StatusBadRequest, "",
-				errors.New("bad action: "+action))
+	items, err := iutil.Get(srv.db, []int{}, []string{}, iutil.ByID)
+	if err != nil {
+		srv.logAndHandleDBError(w, r, user, err)
+		return
+	}
+	p := r.PathValue("path")
+	for _, it := range items {
+		if it.Img.Name == nil || *it.Img.Name != p {
+			continue
+		}
+		var mod iutil.Item
+		noimg := ""
+		mod.Img.Name = &noimg
+		if err = iutil.Mod(r.Context(), srv.db, *it.ID, "", &mod); err != nil {
+			srv.logAndHandleDBError(w, r, user, err)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	handleError(w, r, user, http.StatusNotFound, "")
+}
 
-		for k := range r.PostForm {
-			switch k {
-			case "name":
-				page.Name = r.FormValue(k)
-				continue
-			case "contact":
-				page.Contact = r.FormValue(k)
-				continue
-			case "address":
-				page.Address = r.FormValue(k)
-				continue
-			case "comments":
-				page.Comments = r.FormValue(k)
-				continue
-			}
+// handleOrderCancel cancels the order given by id, if contact is the one
+// it was placed with, and tells the shop.
+func (srv *Server) handleOrderCancel(w http.ResponseWriter, r *http.Request) {
+	if code, err := getForm(w, r); code != http.StatusOK {
+		logAndHandleError(w, r, "", code, "", err)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		logAndHandleError(w, r, "", http.StatusBadRequest, "bad id", err)
+		return
+	}
+	if *cancelWindowFlag <= 0 {
+		handleError(w, r, "", http.StatusForbidden, "orders cannot be canceled")
+		return
+	}
 
-			var id, n int
-			if id, err = stoi(k); err != nil {
-				continue
-			}
-			if n, err = stoi(r.FormValue(k)); n <= 0 || n > 100 || err != nil {
-				continue
-			}
-			ids = append(ids, id)
-			ordered[id] = n
-		}
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
 	}
+	defer srv.dbLock.RUnlock()
 
-	if err := dbConnFix(); err != nil {
-		intErr(err)
+	o, err := outil.Cancel(srv.db, id, r.FormValue("contact"),
+		time.Now().Add(-*cancelWindowFlag))
+	switch {
+	case errors.Is(err, outil.ErrNoOrder):
+		logAndHandleError(w, r, "", http.StatusNotFound, err.Error(), err)
+		return
+	case errors.Is(err, outil.ErrCanceled), errors.Is(err, outil.ErrTooLate):
+		logAndHandleError(w, r, "", http.StatusConflict, err.Error(), err)
+		return
+	case err != nil:
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+
+	srv.notify(fmt.Sprintf("Order #%v canceled\n\nName: %v\nContact: %v\nTotal: %v",
+		o.ID, o.Name, o.Contact, srv.newPrice(o.Total).Str))
+	fmt.Fprintf(w, "Order #%v canceled.\n", o.ID)
+}
+
+// orderStatus is a status given to orders by a button.
+type orderStatus struct {
+	action string // in the callback data
+	status string
+	button string
+	done   string // shown in the message once given
+}
+
+var orderStatuses = []orderStatus{
+	{"accept", outil.Accepted, "Accept", "Accepted"},
+	{"reject", outil.Rejected, "Reject", "Rejected"},
+}
+
+// handleTg handles the updates sent by Telegram to the webhook: the
+// presses of the order buttons, which give the order a status.  Telegram
+// resends an update until it gets a 2xx response, so bad updates are only
+// logged.
+func (srv *Server) handleTg(w http.ResponseWriter, r *http.Request) {
+	if srv.tgSecret == nil || srv.tg == nil {
+		handleError(w, r, "", http.StatusNotFound, "")
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get(tutil.SecretHeader)), srv.tgSecret) {
+		handleError(w, r, "", http.StatusForbidden, "")
 		return
 	}
-	defer dbLock.RUnlock()
 
-	page.Items, err = getItems(ids, []string{})
+	cb, err := tutil.ParseUpdate(http.MaxBytesReader(w, r.Body, 1<<20))
 	if err != nil {
-		intErr(err)
+		errLog.Print("telegram webhook: ", err)
 		return
 	}
+	if cb == nil || !srv.tg.InChat(cb.Chat) {
+		return
+	}
+	action, v, _ := strings.Cut(cb.Data, ":")
+	id, err := strconv.Atoi(v)
+	i := slices.IndexFunc(orderStatuses, func(s orderStatus) bool {
+		return s.action == action
+	})
+	if err != nil || i < 0 {
+		errLog.Print("telegram webhook: bad callback data: ", cb.Data)
+		return
+	}
+	s := orderStatuses[i]
 
-	if page.Checkout {
-		for i := range page.Items {
-			p := &page.Items[i]
-			p.Num = ordered[p.ID]
-			p.Total.Num = p.Price.Num * p.Num
-			p.Total.Str = (*iutil.Price)(&p.Total.Num).String()
-			total += iutil.Price(p.Total.Num)
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	answer := fmt.Sprintf("Order #%v %v", id, s.status)
+	err = outil.SetStatus(srv.db, id, s.status)
+	switch {
+	case errors.Is(err, outil.ErrNoOrder), errors.Is(err, outil.ErrCanceled),
+		errors.Is(err, outil.ErrDecided):
+		answer = fmt.Sprintf("Order #%v: %v", id, err)
+	case err != nil:
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	default:
+		err = tutil.Edit(srv.tg, cb, cb.Text+"\n\n"+s.done+" by "+cb.From)
+		if err != nil {
+			errLog.Print("telegram: ", err)
 		}
-		total += iutil.Price(page.Delivery.Num)
-		page.Total = total.String()
+	}
+	if err = tutil.Answer(srv.tg, cb, answer); err != nil {
+		errLog.Print("telegram: ", err)
+	}
+}
 
-		if page.Ordered {
-			var buf bytes.Buffer
-			tmpls.ExecuteTemplate(&buf, "order.tmpl", page)
-			tutil.Send(tgConf, string(buf.Bytes()))
+// hostMux sends requests to the handler of their host.
+type hostMux map[string]http.Handler
+
+func (m hostMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := m[strings.ToLower(host)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/livez" {
+		handleLive(w, r)
+		return
+	}
+	logAndHandleError(w, r, "", http.StatusNotFound, "", errors.New("unknown host "+host))
+}
+
+// reloadShops reads the shops anew on SIGHUP, by their image directories:
+// those of the -tenants file, or the single one of -config.
+func reloadShops() (shops map[string]Shop, err error) {
+	if *tenantsFlag != "" {
+		return readTenants(*tenantsFlag)
+	}
+	shop, err := reloadShop()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]Shop{"": shop}, nil
+}
+
+// flagShop returns the Shop given by the flags, for serving a single shop.
+func flagShop() (shop Shop) {
+	return Shop{
+		DB:       *dbFlag,
+		Title:    *titleFlag,
+		Currency: iutil.Cur,
+		Token:    *tokenFlag,
+		TokenEnv: *tokenEnvFlag,
+		Chat:     *chatFlag,
+		Notes:    notesFlag,
+		Lang:     *langFlag,
+		Langs:    langs,
+		Rates:    rates,
+
+		Delivery:     *deliveryFlag,
+		FreeDelivery: *freeDeliveryFlag,
+		MinOrder:     *minOrderFlag,
+		Hours:        *hoursFlag,
+		MsgHeader:    *msgHeaderFlag,
+		MsgFooter:    *msgFooterFlag,
+		Webhook:      *webhookFlag,
+		AddrCheck:    *addrCheckFlag,
+
+		APITokens:  *apiTokensFlag,
+		WebhookKey: *webhookKeyFlag,
+		TgSecret:   *tgSecretFlag,
+		CookieKey:  *cookieKeyFlag,
+	}
+}
+
+// explicitFlags are the flags given on the command line or in the
+// environment, which take precedence over -config.
+var explicitFlags = make(map[string]bool)
+
+// reloadShop returns the Shop of flagShop with the title, the notes, the
+// delivery fee, the free delivery total and the minimum order read anew
+// from -config, save for those of explicitFlags.  The other flags are
+// read by the handlers without locking, so changing them takes a restart.
+func reloadShop() (shop Shop, err error) {
+	shop = flagShop()
+	if *configFlag == "" {
+		return shop, nil
+	}
+
+	strs := map[string]*string{
+		"title":        &shop.Title,
+		"delivery":     &shop.Delivery,
+		"freedelivery": &shop.FreeDelivery,
+		"minorder":     &shop.MinOrder,
+	}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	vals := make(map[string]*string)
+	for name := range strs {
+		vals[name] = fs.String(name, flags.Lookup(name).DefValue, "")
+	}
+	var notes lineList
+	fs.Var(&notes, "note", "")
+	if err = util.LoadSharedConfig(fs, *configFlag); err != nil {
+		return shop, errors.New(*configFlag + ": " + err.Error())
+	}
+
+	for name, p := range strs {
+		if !explicitFlags[name] {
+			*p = *vals[name]
 		}
 	}
+	if !explicitFlags["note"] {
+		shop.Notes = notes
+	}
+	return shop, nil
+}
 
-	if err = htmpls.ExecuteTemplate(w, "root.htmpl", page); err != nil {
-		intErr(err)
+// readTenants reads the shops from file, a JSON object keyed by host name.
+func readTenants(file string) (shops map[string]Shop, err error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, &shops); err != nil {
+		return nil, err
+	}
+	for host, shop := range shops {
+		if shop.Title == "" {
+			shop.Title = host
+		}
+		if shop.Currency.Code == "" {
+			shop.Currency = iutil.Cur
+		}
+		if shop.Lang == "" {
+			shop.Lang = *langFlag
+		}
+		if shop.Delivery == "" {
+			shop.Delivery = *deliveryFlag
+		}
+		if shop.MsgHeader == "" {
+			shop.MsgHeader = *msgHeaderFlag
+		}
+		if shop.MsgFooter == "" {
+			shop.MsgFooter = *msgFooterFlag
+		}
+		if shop.Chat == 0 {
+			shop.Chat = math.MaxInt
+		}
+		delete(shops, host)
+		shops[strings.ToLower(host)] = shop
+	}
+	return shops, nil
+}
+
+func (srv *Server) handleFavicon(w http.ResponseWriter, r *http.Request) {
+	if err := srv.dbConnFix(); err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	defer srv.dbLock.RUnlock()
+
+	imgs, err := iutil.Branding(srv.db)
+	if err != nil {
+		srv.logAndHandleDBError(w, r, "", err)
+		return
+	}
+	if img, ok := imgs[iutil.Favicon]; ok {
+		http.ServeFile(w, r, util.ImgPath(img))
 		return
 	}
-	logAccess(r, "", 0, http.StatusOK)
+	http.ServeContent(w, r, "favicon.ico", time.Time{}, bytes.NewReader(defaultFavicon))
+}
+
+func (srv *Server) handleCSS(w http.ResponseWriter, r *http.Request) {
+	http.ServeFileFS(w, r, srv.assets.Load().css, r.PathValue("base"))
+}
+
+// parseFlags parses the flags in args, then the environment and then the
+// config file, if any.
+func parseFlags(args []string) (rest []string) {
+	flags.Parse(args)
+	if err := util.LoadEnv(flags); err != nil {
+		util.Die(err)
+	}
+	flags.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	if *configFlag != "" {
+		if err := util.LoadConfig(flags, *configFlag); err != nil {
+			util.Die(*configFlag + ": " + err.Error())
+		}
+	}
+	if *prefixFlag != "" {
+		*prefixFlag = strings.TrimSuffix(path.Clean("/"+*prefixFlag), "/")
+	}
+	util.ImgDir = path.Clean(*imgDirFlag)
+	if *timeZoneFlag != "" {
+		loc, err := time.LoadLocation(*timeZoneFlag)
+		if err != nil {
+			util.Die(err)
+		}
+		timeLoc = loc
+	}
+	switch *animatedFlag {
+	case "allow", "reject", "flatten":
+	default:
+		util.Die("invalid -animated: " + *animatedFlag)
+	}
+	return flags.Args()
 }
 
-// XXX should be a way to log access
-func handleStatic(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, r.URL.Path[1:])
+// serveDebug serves the pprof profiles under /debug/pprof/ on addr, apart
+// from the shop.  Only loopback IP addresses are allowed, so that the
+// profiles are never public.
+func serveDebug(addr string) (err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || !ip.IsLoopback() {
+		return errors.New("debug address is not a loopback IP address: " + addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		log.Print("serving pprof on " + addr)
+		errLog.Print("pprof: ", http.Serve(l, mux))
+	}()
+	return nil
 }
 
-func handleCSS(w http.ResponseWriter, r *http.Request) {
-	http.ServeFileFS(w, r, cssFS, r.URL.Path[1:])
+// PrintConfig prints the effective serve configuration given the flags in
+// args as JSON, in the format read by -config.
+func PrintConfig(w io.Writer, args []string) (err error) {
+	parseFlags(args)
+	return util.PrintConfig(w, flags, "config")
 }
 
 func Serve(args []string) {
 	var addr string
 	var err error
 
-	flags.Parse(args[1:])
-	args = flags.Args()
+	args = parseFlags(args[1:])
+	if *avifCmdFlag != "" {
+		iutil.ImgConverters["avif"] = *avifCmdFlag
+	}
+	if *webpCmdFlag != "" {
+		iutil.ImgConverters["webp"] = *webpCmdFlag
+	}
+	iutil.HEICConverter = *heicCmdFlag
+	iutil.HEICLimits = imgLimits
+	if *bcryptCostFlag < bcrypt.MinCost || *bcryptCostFlag > bcrypt.MaxCost {
+		util.Die(fmt.Sprintf("-bcryptcost must be from %v to %v",
+			bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	putil.Cost = *bcryptCostFlag
+
+	if err = util.LockImgs(*multiFlag); err != nil {
+		if !*multiFlag {
+			err = fmt.Errorf("%w (is serve already running? see -multi)", err)
+		}
+		errLog.Fatal(err)
+	}
+
+	if *logFileFlag != "" {
+		if err = openLog(); err != nil {
+			errLog.Fatal(err)
+		}
+	}
+
+	// Images added without the converters, e.g. from the command line,
+	// are converted in the background.
+	if len(iutil.ImgConverters) > 0 {
+		go func() {
+			converted, err := iutil.ConvertImgs()
+			for _, img := range converted {
+				log.Print("converted image ", img)
+			}
+			if err != nil {
+				errLog.Print("converting images: ", err)
+			}
+		}()
+	}
+
+	var srvs []*Server
+	var handler http.Handler
+	if *tenantsFlag != "" {
+		if *apiTokensFlag != "" || *webhookKeyFlag != "" || *tgSecretFlag != "" ||
+			*cookieKeyFlag != "" || *webhookFlag != "" || *addrCheckFlag != "" {
 
-	if *tokenFlag != "" {
-		token, err := tutil.ReadToken(*tokenFlag)
+			errLog.Fatal("with -tenants, API tokens, keys, telegram secrets, " +
+				"webhooks and address checking are given per shop, as apitokens, " +
+				"webhookkey, tgsecret, cookiekey, webhook and addrcheck")
+		}
+		shops, err := readTenants(*tenantsFlag)
+		if err != nil {
+			errLog.Fatal(err)
+		}
+		mux := make(hostMux)
+		for host, shop := range shops {
+			srv, err := NewServer(shop, host)
+			if err != nil {
+				errLog.Fatal(host + ": " + err.Error())
+			}
+			srvs = append(srvs, srv)
+			mux[host] = srv.Handler()
+		}
+		handler = mux
+	} else {
+		srv, err := NewServer(flagShop(), "")
 		if err != nil {
-			errLog.Fatal("error reading " + *tokenFlag + ": " + err.Error())
+			errLog.Fatal(err)
 		}
-		tgConf = tutil.NewConf(token, *chatFlag)
+		srvs = append(srvs, srv)
+		handler = srv.Handler()
 	}
 
 	switch len(args) {
 	case 0:
 		addr = "127.0.0.1:8080"
+		if s := os.Getenv(util.EnvPrefix + "LISTEN"); s != "" {
+			addr = s
+		}
 	case 1:
 		addr = args[0]
 	default:
@@ -649,18 +4057,82 @@ func Serve(args []string) {
 	}
 	defer listener.Close()
 
-	http.HandleFunc("/{$}", handleRoot)
-	http.HandleFunc("/admin", handleAdmin)
-	http.HandleFunc("GET /img/{base}", handleStatic)
-	http.HandleFunc("GET /css/{base}", handleCSS)
+	if *debugFlag != "" {
+		if err = serveDebug(*debugFlag); err != nil {
+			errLog.Fatal(err)
+		}
+	}
+
+	// Connect before serving, so that the first requests don't find
+	// the database down only for not having checked it yet.
+	for _, srv := range srvs {
+		srv.checkDB()
+	}
+	for _, srv := range srvs {
+		go srv.superviseDB()
+		srv.noteWG.Add(1)
+		go srv.notifier()
+	}
 
 	sigch := make(chan os.Signal, 1)
-	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
+	hs := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: *headerTimeoutFlag,
+		ReadTimeout:       *readTimeoutFlag,
+		WriteTimeout:      *writeTimeoutFlag,
+		IdleTimeout:       *idleTimeoutFlag,
+	}
 	go func() {
 		log.Print("serving on " + addr)
-		errLog.Fatal(http.Serve(listener, nil))
+		if err := hs.Serve(listener); err != http.ErrServerClosed {
+			errLog.Fatal(err)
+		}
 	}()
 
-	<-sigch
+	for sig := range sigch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if *logFileFlag != "" {
+			if err = openLog(); err != nil {
+				errLog.Print("reopening log: ", err)
+			}
+		}
+		shops, err := reloadShops()
+		if err != nil {
+			errLog.Print("reload failed: ", err)
+		}
+		for _, srv := range srvs {
+			var shop *Shop
+			if s, ok := shops[srv.imgDir]; ok {
+				shop = &s
+			}
+			srv.reload(shop)
+		}
+	}
+
+	// Finish the requests, then send the notifications they queued.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+	defer cancel()
+	if err = hs.Shutdown(ctx); err != nil {
+		// Requests still running may yet queue notifications.
+		errLog.Print("shutdown: ", err)
+		return
+	}
+	drained := make(chan struct{})
+	go func() {
+		for _, srv := range srvs {
+			close(srv.noteStop)
+			close(srv.notes)
+			srv.noteWG.Wait()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errLog.Print("shutdown: notifications left unsent")
+	}
 }
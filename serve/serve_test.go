@@ -0,0 +1,839 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package serve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	iutil "github.com/lexurco/gobuffet/item/util"
+	putil "github.com/lexurco/gobuffet/pw/util"
+	tutil "github.com/lexurco/gobuffet/tg/util"
+	"github.com/lexurco/gobuffet/util"
+	"github.com/lexurco/gobuffet/util/dbtest"
+)
+
+// testPass is the password of admin in the database of testServer.
+const testPass = "secret password"
+
+var testHash, _ = bcrypt.GenerateFromPassword([]byte(testPass), bcrypt.MinCost)
+
+// testRows gives the rows of a shop with a pizza in two sizes and a cola.
+func testRows(sql string, args []any) (rows [][]any, err error) {
+	pizzaDescr, pizzaSlug, colaSlug := "tasty", "pizza", "cola"
+	switch {
+	case strings.HasPrefix(sql, "SELECT pass FROM passwd"):
+		return [][]any{{testHash}}, nil
+	case strings.HasPrefix(sql, "SELECT name FROM passwd"):
+		return [][]any{{"admin"}, {"clerk"}}, nil
+	case strings.HasPrefix(sql, "SELECT count(*) FROM passwd"):
+		return [][]any{{2}}, nil
+	case strings.HasPrefix(sql, "DELETE FROM passwd"):
+		return [][]any{{}}, nil
+	case strings.HasPrefix(sql, "INSERT INTO passwd"):
+		return [][]any{{false}}, nil
+	case strings.Contains(sql, "FILTER (WHERE sold_out_until"):
+		return [][]any{{2, 0, 0, 1}}, nil
+	case strings.HasPrefix(sql, "SELECT id, name, descr, price"):
+		return [][]any{
+			{1, "Pizza", &pizzaDescr, 1000, nil, nil, time.Now(), nil, nil, &pizzaSlug},
+			{2, "Cola", nil, 250, nil, nil, time.Now(), nil, nil, &colaSlug},
+		}, nil
+	case strings.Contains(sql, "FROM variants"):
+		return [][]any{{1, "small", 800}, {1, "large", 1400}}, nil
+	case strings.Contains(sql, "FROM modifiers"):
+		return [][]any{{1, "cheese", 150, true}}, nil
+	case strings.HasPrefix(sql, "INSERT INTO items"):
+		return [][]any{{3}}, nil
+	case strings.HasPrefix(sql, "UPDATE items SET"):
+		return [][]any{{1, "Pizza"}}, nil
+	case strings.HasPrefix(sql, "INSERT INTO orders"):
+		return [][]any{{42, time.Now()}}, nil
+	}
+	return nil, nil
+}
+
+// testServer returns a Server of the shop of testRows, with a fake
+// database and a telegram sender collecting the messages sent.
+func testServer(t *testing.T) (srv *Server, db *dbtest.DB, sent func() []string) {
+	t.Helper()
+	srv, err := NewServer(Shop{
+		Title:    "Test Shop",
+		Currency: iutil.Cur,
+		Delivery: "5",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putil.Cost = bcrypt.MinCost
+	db = &dbtest.DB{Rows: testRows}
+	srv.db = db
+	srv.dbUp.Store(true)
+
+	var mu sync.Mutex
+	var msgs []string
+	srv.tg = tutil.NewConf("token", 1)
+	srv.send = func(conf *tutil.Conf, msg string, buttons []tutil.Button) (err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, msg)
+		return nil
+	}
+	srv.noteWG.Add(1)
+	go srv.notifier()
+	t.Cleanup(func() {
+		close(srv.notes)
+		srv.noteWG.Wait()
+	})
+
+	// The notifier sends in the background, so the messages are only
+	// all there once it is done.
+	sent = func() []string {
+		close(srv.notes)
+		srv.noteWG.Wait()
+		srv.notes = make(chan note, noteQueue)
+		srv.noteWG.Add(1)
+		go srv.notifier()
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), msgs...)
+	}
+	return srv, db, sent
+}
+
+// serveTest runs a request of srv, with form as its body if given, and
+// with basic authentication if user is given.
+func serveTest(srv *Server, method, target string, form url.Values,
+	user, pass string) (w *httptest.ResponseRecorder) {
+
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestRootMenu(t *testing.T) {
+	srv, _, _ := testServer(t)
+	w := serveTest(srv, "GET", "/", nil, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET / = %v", w.Code)
+	}
+	for _, s := range []string{"Test Shop", "Pizza", "tasty", "Cola", "2.50", "large"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("menu lacks %q", s)
+		}
+	}
+}
+
+func TestRootCheckout(t *testing.T) {
+	srv, db, sent := testServer(t)
+	form := url.Values{
+		"action":    {"checkout"},
+		"item[1]":   {"2"},
+		"variant_1": {"large"},
+		"item[2]":   {"1"},
+		"name":      {"Jane"},
+		"contact":   {"555"},
+		"address":   {"1 Main St"},
+	}
+	w := serveTest(srv, "POST", "/", form, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout = %v", w.Code)
+	}
+	// 2 large pizzas at 14.00, a cola at 2.50 and delivery at 5.00.
+	for _, s := range []string{"Order!", "5.00", "35.50"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("checkout lacks %q", s)
+		}
+	}
+	if _, ok := db.Find("INSERT INTO orders"); ok {
+		t.Error("checkout placed an order")
+	}
+
+	form.Set("action", "order")
+	w = serveTest(srv, "POST", "/", form, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("order = %v", w.Code)
+	}
+	stmt, ok := db.Find("INSERT INTO orders")
+	if !ok {
+		t.Fatal("no order placed")
+	}
+	if total := stmt.Args[7]; total != 3550 {
+		t.Errorf("order total %v, want 3550", total)
+	}
+	msgs := sent()
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "Pizza") ||
+		!strings.Contains(msgs[0], "Jane") {
+
+		t.Errorf("sent %q, want one message of the order", msgs)
+	}
+}
+
+func TestRootSoldOut(t *testing.T) {
+	srv, db, sent := testServer(t)
+	until := time.Now().Add(time.Hour)
+	db.Rows = func(sql string, args []any) (rows [][]any, err error) {
+		if strings.HasPrefix(sql, "SELECT id, name, descr, price") {
+			pizzaSlug, colaSlug := "pizza", "cola"
+			return [][]any{
+				{1, "Pizza", nil, 1000, nil, nil, time.Now(), nil, nil, &pizzaSlug},
+				{2, "Cola", nil, 250, nil, nil, time.Now(), &until, nil, &colaSlug},
+			}, nil
+		}
+		return testRows(sql, args)
+	}
+	for _, items := range []url.Values{
+		{"item[1]": {"2"}, "item[2]": {"1"}},
+		{"item[2]": {"1"}},
+		{"item[1]": {"0"}},
+	} {
+		form := url.Values{
+			"action":  {"order"},
+			"name":    {"Jane"},
+			"contact": {"555"},
+			"address": {"1 Main St"},
+		}
+		for k, v := range items {
+			form[k] = v
+		}
+		w := serveTest(srv, "POST", "/", form, "", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("order of %v = %v, want 400", items, w.Code)
+		}
+		if _, sold := items["item[2]"]; sold && !strings.Contains(w.Body.String(), "order: Cola") {
+			t.Errorf("order of %v: error doesn't name the cola", items)
+		}
+	}
+	if _, ok := db.Find("INSERT INTO orders"); ok {
+		t.Error("order placed with sold-out or no items")
+	}
+	if msgs := sent(); len(msgs) > 0 {
+		t.Errorf("sent %q", msgs)
+	}
+}
+
+func TestRootMissingDetails(t *testing.T) {
+	srv, db, _ := testServer(t)
+	w := serveTest(srv, "POST", "/", url.Values{
+		"action":  {"order"},
+		"item[2]": {"1"},
+		"name":    {"Jane"},
+	}, "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("order without contact = %v, want 400", w.Code)
+	}
+	if _, ok := db.Find("INSERT INTO orders"); ok {
+		t.Error("order placed without contact")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv, _, _ := testServer(t)
+	for _, c := range []struct {
+		user, pass string
+		code       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"admin", "", http.StatusUnauthorized},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"admin", testPass, http.StatusOK},
+	} {
+		w := serveTest(srv, "GET", "/admin", nil, c.user, c.pass)
+		if w.Code != c.code {
+			t.Errorf("%q:%q: GET /admin = %v, want %v", c.user, c.pass, w.Code, c.code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q:%q: no WWW-Authenticate", c.user, c.pass)
+		}
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	for _, c := range []struct {
+		form url.Values
+		code int
+		stmt string // run by the action
+		body string // in the page
+	}{
+		{url.Values{"action": {"itemadd"}, "name": {"Pie"}, "price": {"9.00"}},
+			http.StatusOK, "INSERT INTO items", ""},
+		{url.Values{"action": {"itemmod"}, "id": {"1"}, "price": {"11.00"}},
+			http.StatusOK, "UPDATE items SET price", ""},
+		{url.Values{"action": {"itemmod"}, "id": {"x"}},
+			http.StatusBadRequest, "", ""},
+		{url.Values{"action": {"itemdel"}, "id": {"1", "2"}},
+			http.StatusOK, "DELETE FROM items", "Deleted"},
+		{url.Values{"action": {"itemdel"}},
+			http.StatusOK, "", "No items selected."},
+		{url.Values{"action": {"soldout"}, "id": {"2"}},
+			http.StatusOK, "UPDATE items SET sold_out_until", ""},
+		{url.Values{"action": {"instock"}, "id": {"2"}},
+			http.StatusOK, "UPDATE items SET sold_out_until", ""},
+		{url.Values{"action": {"imgdel"}, "id": {"1"}},
+			http.StatusOK, "UPDATE items SET img", ""},
+		{url.Values{"action": {"chpass"}, "password": {"new password"},
+			"repeat": {"new password"}},
+			http.StatusOK, "INSERT INTO passwd", ""},
+		{url.Values{"action": {"chpass"}, "password": {"new password"},
+			"repeat": {"other password"}},
+			http.StatusOK, "", "passwords do not match"},
+		{url.Values{"action": {"userdel"}, "name": {"clerk"}},
+			http.StatusOK, "DELETE FROM passwd", "Deleted user clerk."},
+		{url.Values{"action": {"settings"}, "title": {"New Shop"}},
+			http.StatusOK, "INSERT INTO settings", "Settings saved."},
+		{url.Values{"action": {"settings"}, "delivery": {"free"}},
+			http.StatusBadRequest, "", "invalid price"},
+		{url.Values{"action": {"preview"}},
+			http.StatusOK, "", "Jane &lt;Doe&gt;"},
+		{url.Values{"action": {"nonsense"}},
+			http.StatusBadRequest, "", ""},
+	} {
+		srv, db, _ := testServer(t)
+		w := serveTest(srv, "POST", "/admin", c.form, "admin", testPass)
+		if w.Code != c.code {
+			t.Errorf("%v = %v, want %v", c.form, w.Code, c.code)
+		}
+		if _, ok := db.Find(c.stmt); c.stmt != "" && !ok {
+			t.Errorf("%v ran no %v", c.form, c.stmt)
+		}
+		if !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%v: page lacks %q", c.form, c.body)
+		}
+	}
+}
+
+func TestAdminUser(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	// clerk changes their own password, not admin's.
+	srv, db, _ := testServer(t)
+	w := serveTest(srv, "POST", "/admin", url.Values{
+		"action":   {"chpass"},
+		"password": {"new password"},
+		"repeat":   {"new password"},
+	}, "clerk", testPass)
+	if w.Code != http.StatusOK {
+		t.Fatalf("chpass = %v", w.Code)
+	}
+	stmt, ok := db.Find("INSERT INTO passwd")
+	if !ok {
+		t.Fatal("no password set")
+	}
+	if stmt.Args[0] != "clerk" {
+		t.Errorf("password of %v set, want clerk", stmt.Args[0])
+	}
+	if !strings.Contains(logBuf.String(), " clerk \"POST /admin") {
+		t.Errorf("access not logged as clerk: %q", logBuf.String())
+	}
+}
+
+func TestAdminAddErrors(t *testing.T) {
+	srv, db, _ := testServer(t)
+	w := serveTest(srv, "POST", "/admin", url.Values{
+		"action": {"itemadd"},
+		"name":   {"Pie"},
+		"price":  {"nine"},
+	}, "admin", testPass)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("itemadd with a bad price = %v, want 400", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `value="Pie"`) {
+		t.Error("add form not filled in again")
+	}
+	if _, ok := db.Find("INSERT INTO items"); ok {
+		t.Error("item added with a bad price")
+	}
+}
+
+func TestAdminTestSend(t *testing.T) {
+	srv, _, sent := testServer(t)
+	w := serveTest(srv, "POST", "/admin", url.Values{"action": {"testsend"}},
+		"admin", testPass)
+	if w.Code != http.StatusOK {
+		t.Fatalf("testsend = %v", w.Code)
+	}
+	if msgs := sent(); len(msgs) != 1 || !strings.Contains(msgs[0], "TEST") ||
+		!strings.Contains(msgs[0], "Pizza") {
+
+		t.Errorf("sent %q, want the sample order", msgs)
+	}
+}
+
+func TestNotifierStop(t *testing.T) {
+	tried := make(chan struct{}, noteTries)
+	srv := &Server{
+		tg: tutil.NewConf("token", 1),
+		send: func(conf *tutil.Conf, msg string, buttons []tutil.Button) (err error) {
+			tried <- struct{}{}
+			return errors.New("down")
+		},
+		notes:    make(chan note, noteQueue),
+		noteStop: make(chan struct{}),
+	}
+	srv.noteWG.Add(1)
+	go srv.notifier()
+	srv.notes <- note{msg: "first"}
+	srv.notes <- note{msg: "second"}
+	<-tried
+
+	// The first notification is waiting to be retried; stopping must
+	// cut that short and try the second only once.
+	start := time.Now()
+	close(srv.noteStop)
+	close(srv.notes)
+	srv.noteWG.Wait()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("notifier took %v to stop", d)
+	}
+	if n := 1 + len(tried); n != 2 {
+		t.Errorf("%v attempts, want 2", n)
+	}
+}
+
+func TestCheckDB(t *testing.T) {
+	srv, err := NewServer(Shop{Title: "Test Shop", Currency: iutil.Cur}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.dbUp.Load() {
+		t.Fatal("database up before connecting")
+	}
+	srv.connect = func(s string) (db database, err error) {
+		return &dbtest.DB{Rows: testRows}, nil
+	}
+	if err = srv.checkDB(); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.dbUp.Load() {
+		t.Error("database not up after connecting")
+	}
+}
+
+func TestFetchedHEIC(t *testing.T) {
+	heic := bytes.NewReader(append([]byte("\x00\x00\x00\x18ftypheic"), make([]byte, 100)...))
+	if !fetchedHEIC(heic) {
+		t.Error("HEIC not recognized")
+	}
+	if pos, _ := heic.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Errorf("HEIC left at %v", pos)
+	}
+	for _, b := range []string{"\x89PNG\r\n\x1a\n", ""} {
+		if fetchedHEIC(bytes.NewReader([]byte(b))) {
+			t.Errorf("%q taken for HEIC", b)
+		}
+	}
+}
+
+func TestOrderLimits(t *testing.T) {
+	defer func(items, qty int) {
+		*maxItemsFlag, *maxQtyFlag = items, qty
+	}(*maxItemsFlag, *maxQtyFlag)
+	*maxItemsFlag, *maxQtyFlag = 2, 5
+
+	srv, _, _ := testServer(t)
+	for _, c := range []struct {
+		items map[string]string
+		code  int
+		body  string
+	}{
+		{map[string]string{"1": "1", "2": "4"}, http.StatusOK, "Order!"},
+		{map[string]string{"1": "1", "2": "5"}, http.StatusBadRequest,
+			"too many items in total (max 5)"},
+		{map[string]string{"1": "1", "2": "1", "3": "1"}, http.StatusBadRequest,
+			"too many different items (max 2)"},
+		{map[string]string{"1": "1", "2": "1", "3": "0"}, http.StatusOK, "Order!"},
+	} {
+		form := url.Values{
+			"action":    {"checkout"},
+			"variant_1": {"small"},
+			"name":      {"Jane"},
+			"contact":   {"555"},
+			"address":   {"1 Main St"},
+		}
+		for id, n := range c.items {
+			form.Set("item["+id+"]", n)
+		}
+		w := serveTest(srv, "POST", "/", form, "", "")
+		if w.Code != c.code || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%v = %v %q, want %v %q", c.items, w.Code,
+				w.Body.String(), c.code, c.body)
+		}
+	}
+}
+
+func TestFmtTime(t *testing.T) {
+	defer func(loc *time.Location, layout string) {
+		timeLoc, *timeFmtFlag = loc, layout
+	}(timeLoc, *timeFmtFlag)
+	timeLoc = time.FixedZone("GET", 4*60*60)
+
+	ordered := time.Date(2025, 1, 2, 22, 30, 0, 0, time.UTC)
+	if s := fmtTime(ordered); s != "2025-01-03 02:30" {
+		t.Errorf("fmtTime = %q, want 2025-01-03 02:30", s)
+	}
+	*timeFmtFlag = "15:04 MST"
+	if s := fmtTime(ordered); s != "02:30 GET" {
+		t.Errorf("fmtTime with -timefmt = %q, want 02:30 GET", s)
+	}
+
+	// The time of an order, as the database gives it, on the order page.
+	*timeFmtFlag = "2006-01-02 15:04"
+	srv, db, _ := testServer(t)
+	db.Rows = func(sql string, args []any) (rows [][]any, err error) {
+		if strings.HasPrefix(sql, "INSERT INTO orders") {
+			return [][]any{{42, ordered}}, nil
+		}
+		return testRows(sql, args)
+	}
+	w := serveTest(srv, "POST", "/", url.Values{
+		"action":  {"order"},
+		"item[2]": {"1"},
+		"name":    {"Jane"},
+		"contact": {"555"},
+		"address": {"1 Main St"},
+	}, "", "")
+	if !strings.Contains(w.Body.String(), "completed at 2025-01-03 02:30") {
+		t.Errorf("order page lacks the time in -timezone")
+	}
+}
+
+func TestOrderFieldNames(t *testing.T) {
+	srv, db, _ := testServer(t)
+
+	// Customer fields and others with numbers for values, and keys
+	// that look like items without being any, leave the order alone.
+	w := serveTest(srv, "POST", "/", url.Values{
+		"action":    {"order"},
+		"item[2]":   {"1"},
+		"name":      {"1"},
+		"contact":   {"2"},
+		"address":   {"1"},
+		"comments":  {"2"},
+		"tip":       {"1"},
+		"q":         {"1"},
+		"lang":      {"2"},
+		"variant_1": {"1"},
+		"02":        {"5"},
+		"+1":        {"5"},
+		"1.0":       {"5"},
+		"item":      {"1"},
+	}, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("order = %v", w.Code)
+	}
+	var lines []dbtest.Stmt
+	for _, s := range db.Stmts() {
+		if strings.HasPrefix(s.SQL, "INSERT INTO order_items") {
+			lines = append(lines, s)
+		}
+	}
+	if len(lines) != 1 || lines[0].Args[1] != 2 || lines[0].Args[6] != 1 {
+		t.Errorf("order lines %v, want one cola", lines)
+	}
+	if o, _ := db.Find("INSERT INTO orders"); o.Args[0] != "1" || o.Args[1] != "2" {
+		t.Errorf("order of %v, want name 1 and contact 2", o.Args)
+	}
+
+	// Item keys must be of items.
+	for _, k := range []string{"item[name]", "item[2]x", "item[0]", "item[-1]",
+		"item[]", "item[02]", "item[1e1]"} {
+
+		w := serveTest(srv, "POST", "/", url.Values{
+			"action":  {"checkout"},
+			k:         {"1"},
+			"name":    {"Jane"},
+			"contact": {"555"},
+			"address": {"1 Main St"},
+		}, "", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v = %v, want 400", k, w.Code)
+		}
+	}
+}
+
+func TestTenantSecrets(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha256.Sum256([]byte("token a"))
+	file := dir + "/tokens"
+	if err := os.WriteFile(file, []byte(hex.EncodeToString(sum[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := dir + "/cookiekey"
+	if err := os.WriteFile(key, []byte("cookie key of a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewServer(Shop{Title: "A", Currency: iutil.Cur, APITokens: file,
+		CookieKey: key, Webhook: "http://a.example/orders",
+		AddrCheck: "http://a.example/check"}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewServer(Shop{Title: "B", Currency: iutil.Cur}, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(a.cookieKey) != "cookie key of a" || bytes.Equal(b.cookieKey, a.cookieKey) {
+		t.Errorf("cookie keys %q and %q", a.cookieKey, b.cookieKey)
+	}
+	if a.webhook != "http://a.example/orders" || b.webhook != "" {
+		t.Errorf("webhooks %q and %q", a.webhook, b.webhook)
+	}
+	if a.addrCheck != (httpAddrCheck{"http://a.example/check"}) ||
+		b.addrCheck != (noAddrCheck{}) {
+
+		t.Errorf("address checks %v and %v", a.addrCheck, b.addrCheck)
+	}
+	for _, c := range []struct {
+		srv  *Server
+		code int
+	}{{a, http.StatusOK}, {b, http.StatusUnauthorized}} {
+		c.srv.db = &dbtest.DB{Rows: testRows}
+		c.srv.dbUp.Store(true)
+		r := httptest.NewRequest("GET", "/api/items", nil)
+		r.Header.Set("Authorization", "Bearer token a")
+		w := httptest.NewRecorder()
+		c.srv.Handler().ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%v: token of A = %v, want %v", c.srv.shop().title, w.Code, c.code)
+		}
+	}
+}
+
+// serveJSON serves a POST of the JSON body to target.
+func serveJSON(srv *Server, target, body string) (w *httptest.ResponseRecorder) {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestRootJSON(t *testing.T) {
+	srv, db, _ := testServer(t)
+
+	// Items are checked like item[ID] form fields, not skipped like
+	// bare IDs.
+	w := serveJSON(srv, "/", `{"action": "checkout", "items": {"1": 1, "2": -1},
+		"name": "Jane", "contact": "555", "address": "1 Main St"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("negative quantity = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	w = serveJSON(srv, "/", `{"action": "order", "items": {"1": 2, "2": 1},
+		"sizes": {"1": "large"}, "name": "Jane", "contact": "555",
+		"address": "1 Main St"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("order = %v: %v", w.Code, w.Body)
+	}
+	stmt, ok := db.Find("INSERT INTO orders")
+	if !ok {
+		t.Fatal("no order placed")
+	}
+	if total := stmt.Args[7]; total != 3550 {
+		t.Errorf("order total %v, want 3550", total)
+	}
+}
+
+func TestMinFill(t *testing.T) {
+	defer func(d time.Duration) { *minFillFlag = d }(*minFillFlag)
+	*minFillFlag = time.Minute
+	srv, db, _ := testServer(t)
+	form := url.Values{
+		"action":  {"order"},
+		"item[2]": {"1"},
+		"name":    {"Jane"},
+		"contact": {"555"},
+		"address": {"1 Main St"},
+	}
+	for _, c := range []struct {
+		name string
+		time string
+		ok   bool
+	}{
+		{"no form time", "", false},
+		{"forged", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10) + "~x", false},
+		{"too fast", srv.formToken(time.Now()), false},
+		{"in time", srv.formToken(time.Now().Add(-time.Hour)), true},
+		{"replayed", srv.formToken(time.Now().Add(-formMaxAge - time.Hour)), false},
+	} {
+		db.Reset()
+		form.Set(formTimeField, c.time)
+		serveTest(srv, "POST", "/", form, "", "")
+		if _, ok := db.Find("INSERT INTO orders"); ok != c.ok {
+			t.Errorf("%v: order placed %v, want %v", c.name, ok, c.ok)
+		}
+	}
+
+	// Orders sent as JSON have no form time.
+	db.Reset()
+	w := serveJSON(srv, "/", `{"action": "order", "items": {"2": 1},
+		"name": "Jane", "contact": "555", "address": "1 Main St"}`)
+	if _, ok := db.Find("INSERT INTO orders"); !ok {
+		t.Errorf("JSON order refused: %v", w.Code)
+	}
+}
+
+func TestReloadShop(t *testing.T) {
+	defer func(config, minOrder string, explicit map[string]bool) {
+		*configFlag, *minOrderFlag, explicitFlags = config, minOrder, explicit
+	}(*configFlag, *minOrderFlag, explicitFlags)
+
+	file := t.TempDir() + "/gobuffet.json"
+	conf := `{"title": "New Title", "delivery": "7", "minorder": "10",
+		"note": ["Fresh"], "maxitems": 3}`
+	if err := os.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	*configFlag = file
+	// -minorder was given on the command line.
+	*minOrderFlag = "20"
+	explicitFlags = map[string]bool{"minorder": true}
+
+	srv, _, _ := testServer(t)
+	shops, err := reloadShops()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shop, ok := shops[""]
+	if !ok {
+		t.Fatalf("reloaded %v, want the single shop", shops)
+	}
+	srv.reload(&shop)
+	c := srv.shop()
+	if c.title != "New Title" || c.delivery != 700 || c.minOrder != 2000 ||
+		!reflect.DeepEqual(c.notes, []string{"Fresh"}) {
+
+		t.Errorf("reloaded %+v", *c)
+	}
+	w := serveTest(srv, "GET", "/", nil, "", "")
+	if !strings.Contains(w.Body.String(), "New Title") {
+		t.Error("menu lacks the new title")
+	}
+}
+
+func TestItemPage(t *testing.T) {
+	srv, db, _ := testServer(t)
+	until := time.Now().Add(time.Hour)
+	pizzaSlug, colaSlug := "pizza", "cola"
+	pizza := []any{1, "Pizza", nil, 1000, nil, nil, time.Now(), nil, nil, &pizzaSlug}
+	cola := []any{2, "Cola", nil, 250, nil, nil, time.Now(), &until, nil, &colaSlug}
+	db.Rows = func(sql string, args []any) (rows [][]any, err error) {
+		if !strings.HasPrefix(sql, "SELECT id, name, descr, price") {
+			return testRows(sql, args)
+		}
+		for _, row := range [][]any{pizza, cola} {
+			if args[0] == row[0] || args[0] == *row[9].(*string) {
+				return [][]any{row}, nil
+			}
+		}
+		return nil, nil
+	}
+	for _, c := range []struct {
+		target string
+		code   int
+	}{
+		{"/item/pizza", http.StatusOK},
+		{"/item/1", http.StatusOK},
+		{"/item/cola", http.StatusNotFound},
+		{"/item/2", http.StatusNotFound},
+		{"/item/nonexistent", http.StatusNotFound},
+	} {
+		w := serveTest(srv, "GET", c.target, nil, "", "")
+		if w.Code != c.code {
+			t.Errorf("%v = %v, want %v", c.target, w.Code, c.code)
+		}
+		if c.code == http.StatusOK && !strings.Contains(w.Body.String(), "Pizza") {
+			t.Errorf("%v lacks the pizza", c.target)
+		}
+	}
+	if _, ok := db.Find("WHERE slug = $1"); !ok {
+		t.Error("slug not looked up in the database")
+	}
+}
+
+func TestImgDotfile(t *testing.T) {
+	srv, _, _ := testServer(t)
+	util.ImgDir = t.TempDir()
+	defer func() { util.ImgDir = "img" }()
+	for _, f := range []string{"a.jpg", ".lock"} {
+		if err := os.WriteFile(util.ImgPath(f), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		target string
+		code   int
+	}{
+		{"/img/a.jpg", http.StatusOK},
+		{"/img/.lock", http.StatusNotFound},
+	} {
+		if w := serveTest(srv, "GET", c.target, nil, "", ""); w.Code != c.code {
+			t.Errorf("GET %v = %v, want %v", c.target, w.Code, c.code)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv, _, _ := testServer(t)
+	for _, c := range []struct {
+		method, target string
+		code           int
+		allow          string
+	}{
+		{"GET", "/nonexistent", http.StatusNotFound, ""},
+		{"HEAD", "/nonexistent", http.StatusNotFound, ""},
+		{"POST", "/nonexistent", http.StatusNotFound, ""},
+		{"POST", "/robots.txt", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"DELETE", "/item/pizza", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"POST", "/img/a.jpg", http.StatusMethodNotAllowed, "GET, HEAD, DELETE"},
+		{"GET", "/order/cancel", http.StatusMethodNotAllowed, "POST"},
+	} {
+		w := serveTest(srv, c.method, c.target, nil, "", "")
+		if w.Code != c.code {
+			t.Errorf("%v %v = %v, want %v", c.method, c.target, w.Code, c.code)
+		}
+		if allow := w.Header().Get("Allow"); allow != c.allow {
+			t.Errorf("%v %v: Allow %q, want %q", c.method, c.target, allow, c.allow)
+		}
+	}
+}
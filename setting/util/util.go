@@ -0,0 +1,119 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package util
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lexurco/gobuffet/util"
+)
+
+// The keys of the settings.  Amounts are in minor units.
+const (
+	Title        = "title"
+	Delivery     = "delivery"     // fee
+	FreeDelivery = "freedelivery" // order total delivery is free from, if > 0
+	MinOrder     = "minorder"
+	Notes        = "notes" // shown under the menu, one per line
+)
+
+// Keys are all the keys of the settings.
+var Keys = []string{Title, Delivery, FreeDelivery, MinOrder, Notes}
+
+var ErrUnknown = errors.New("unknown setting")
+
+// Settings are the settings stored in the database, by key.  Those not
+// stored are left to the flags and the config file.
+type Settings map[string]string
+
+// Get returns the settings stored in db.
+func Get(db util.DB) (s Settings, err error) {
+	rows, err := db.Query(context.Background(), "SELECT key, value FROM settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s = make(Settings)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		s[k] = v
+	}
+	return s, rows.Err()
+}
+
+// String returns the setting of key, or def if there is none.
+func (s Settings) String(key, def string) (v string) {
+	if v, ok := s[key]; ok {
+		return v
+	}
+	return def
+}
+
+// Int is like String for integers.  A setting that isn't one is none.
+func (s Settings) Int(key string, def int) (n int) {
+	n, err := strconv.Atoi(s[key])
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// Lines is like String for lists of lines.
+func (s Settings) Lines(key string, def []string) (lines []string) {
+	v, ok := s[key]
+	if !ok {
+		return def
+	}
+	if v == "" {
+		return []string{}
+	}
+	return strings.Split(v, "\n")
+}
+
+// Set stores value as the setting of key.
+func Set(db util.DB, key, value string) (err error) {
+	if !slices.Contains(Keys, key) {
+		return ErrUnknown
+	}
+	_, err = db.Exec(context.Background(),
+		`INSERT INTO settings (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, key, value)
+	return err
+}
+
+// SetInt is like Set for integers.
+func SetInt(db util.DB, key string, n int) (err error) {
+	return Set(db, key, strconv.Itoa(n))
+}
+
+// SetLines is like Set for lists of lines, which mustn't have newlines.
+func SetLines(db util.DB, key string, lines []string) (err error) {
+	return Set(db, key, strings.Join(lines, "\n"))
+}
+
+// Del removes the setting of key, leaving it to the flags and the config
+// file again.
+func Del(db util.DB, key string) (err error) {
+	_, err = db.Exec(context.Background(), "DELETE FROM settings WHERE key = $1", key)
+	return err
+}
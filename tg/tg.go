@@ -15,37 +15,75 @@
 package tg
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"math"
 	"os"
+	"strings"
+	"time"
 
+	iutil "github.com/lexurco/gobuffet/item/util"
+	outil "github.com/lexurco/gobuffet/order/util"
 	tutil "github.com/lexurco/gobuffet/tg/util"
 	"github.com/lexurco/gobuffet/util"
 )
 
 var flags = flag.NewFlagSet(os.Args[0]+" tg", flag.ExitOnError)
 var tokenFlag = flags.String("token", "", "file containing the API token")
+var tokenEnvFlag = flags.String("tokenenv", "",
+	"environment variable containing the API token (instead of -token)")
 var chatFlag = flags.Int("chat", math.MaxInt, "chat ID")
+var dbFlag = flags.String("db", "",
+	"database connection string or URI for poll (environment is used if empty)")
+var secretFlag = flags.String("secret", "",
+	"file containing the secret of the webhook, as given to serve -tgsecret")
+var configFlag = flags.String("config", "",
+	"JSON file of serve flags, of which those of tg are used")
+
+func init() {
+	iutil.CurFlags(flags)
+}
 
 func Tg(args []string) {
 	var msg string
 
 	flags.Parse(args[1:])
 	args = flags.Args()
+	if err := util.LoadEnv(flags); err != nil {
+		util.Die(err)
+	}
+	if *configFlag != "" {
+		if err := util.LoadSharedConfig(flags, *configFlag); err != nil {
+			util.Die(*configFlag + ": " + err.Error())
+		}
+	}
 
-	if *tokenFlag == "" {
-		util.Die("token file be empty")
+	if *tokenFlag == "" && *tokenEnvFlag == "" {
+		util.Die("please provide the token file or variable")
 	}
 	if *chatFlag == math.MaxInt {
 		util.Die("please provide the chat id")
 	}
 
-	token, err := tutil.ReadToken(*tokenFlag)
+	conf, err := tutil.LoadConf(*tokenFlag, *tokenEnvFlag, *chatFlag)
 	if err != nil {
-		util.Die("error reading " + *tokenFlag + ": " + err.Error())
+		util.Die(err)
+	}
+
+	if len(args) > 0 && args[0] == "test" {
+		test(conf, args)
+		return
+	}
+	if len(args) > 0 && args[0] == "webhook" {
+		webhook(conf, args)
+		return
+	}
+	if len(args) > 0 && args[0] == "poll" {
+		poll(conf, args)
+		return
 	}
-	conf := tutil.NewConf(token, *chatFlag)
 
 	switch len(args) {
 	case 0:
@@ -57,10 +95,166 @@ func Tg(args []string) {
 	case 1:
 		msg = args[0]
 	default:
-		util.Die("usage: " + flags.Name() + " [option ...] [message]")
+		util.Die("usage: " + flags.Name() +
+			" [option ...] [message | test | webhook [url] | poll]")
 	}
 
 	if err = tutil.Send(conf, msg); err != nil {
 		util.Die(err)
 	}
 }
+
+// test checks the token and that messages reach the chat.
+func test(conf *tutil.Conf, args []string) {
+	if len(args) != 1 {
+		util.Die("usage: " + flags.Name() + " [option ...] test")
+	}
+
+	name, err := tutil.GetMe(conf)
+	if err != nil {
+		util.Die("the token doesn't work: " + err.Error())
+	}
+	fmt.Println("token OK: the bot is @" + name)
+
+	if err = tutil.Send(conf, "gobuffet: configuration OK"); err != nil {
+		util.Die(fmt.Sprintf("cannot send to chat %v "+
+			"(is the bot a member of it?): %v", *chatFlag, err))
+	}
+	fmt.Println("chat OK: a test message was sent to", *chatFlag)
+}
+
+// webhook has Telegram send the presses of the order buttons to url, or
+// stops it if there is no url.
+func webhook(conf *tutil.Conf, args []string) {
+	var url, secret string
+	switch len(args) {
+	case 1:
+	case 2:
+		url = args[1]
+		if *secretFlag == "" {
+			util.Die("please provide the secret file")
+		}
+		b, err := os.ReadFile(*secretFlag)
+		if err != nil {
+			util.Die(err)
+		}
+		secret = strings.TrimSpace(string(b))
+	default:
+		util.Die("usage: " + flags.Name() + " [option ...] webhook [url]")
+	}
+
+	if err := tutil.SetWebhook(conf, url, secret); err != nil {
+		util.Die(err)
+	}
+}
+
+const (
+	pollTimeout = 50 * time.Second // of a getUpdates call
+	pollRetry   = 10 * time.Second // wait after a failed one
+	findMax     = 10               // items listed by /find
+)
+
+const help = `/today - summary of today's orders
+/find name - items whose name or description has name`
+
+// poll answers the commands sent to the bot in the chat until killed.
+// Each update is confirmed before it is handled, so that no command is
+// carried out twice, even if poll is restarted.
+func poll(conf *tutil.Conf, args []string) {
+	if len(args) != 1 {
+		util.Die("usage: " + flags.Name() + " [option ...] poll")
+	}
+
+	db, err := util.DBConnect(*dbFlag)
+	if err != nil {
+		util.Die(err)
+	}
+
+	offset := 0
+	for {
+		msgs, next, err := tutil.GetUpdates(conf, offset, pollTimeout)
+		if err == nil && next != offset {
+			err = tutil.Confirm(conf, next)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			time.Sleep(pollRetry)
+			continue
+		}
+		offset = next
+
+		for _, m := range msgs {
+			if !conf.InChat(m.Chat) {
+				continue
+			}
+			reply, err := command(db, m.Text)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				reply = "Error: " + err.Error()
+				// The connection may have been lost.
+				if c, err := util.DBConnect(*dbFlag); err == nil {
+					db.Close(context.Background())
+					db = c
+				}
+			}
+			if reply == "" {
+				continue
+			}
+			if err = tutil.Send(conf, reply); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+}
+
+// command carries out the command in text, returning the reply, if any.
+func command(db util.DB, text string) (reply string, err error) {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(text), " ")
+	// In groups, commands may be addressed to a bot as /command@bot.
+	cmd, _, _ = strings.Cut(cmd, "@")
+	arg = strings.TrimSpace(arg)
+
+	switch cmd {
+	case "/today":
+		s, err := outil.Summarize(db, time.Now(), 5)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "%v: %v orders, %v, of which delivery %v", s.Date, s.Orders,
+			iutil.Cur.Format(s.Revenue), iutil.Cur.Format(s.Delivery))
+		for _, t := range s.Top {
+			fmt.Fprintf(&b, "\n%v x %v, %v", t.Num, t.Name, iutil.Cur.Format(t.Revenue))
+		}
+		return b.String(), nil
+	case "/find":
+		if arg == "" {
+			return "usage: /find name", nil
+		}
+		items, err := iutil.Search(db, arg, iutil.ByRelevance)
+		if err != nil {
+			return "", err
+		}
+		if len(items) == 0 {
+			return "no items found", nil
+		}
+		var lines []string
+		for _, it := range items[:min(len(items), findMax)] {
+			l := fmt.Sprintf("#%v %v", *it.ID, *it.Name)
+			if it.Price != nil {
+				l += ", " + iutil.Cur.Format(*it.Price)
+			}
+			if it.SoldOut(time.Now()) {
+				l += ", sold out"
+			}
+			lines = append(lines, l)
+		}
+		if len(items) > findMax {
+			lines = append(lines, fmt.Sprintf("and %v more", len(items)-findMax))
+		}
+		return strings.Join(lines, "\n"), nil
+	case "/help", "/start":
+		return help, nil
+	}
+	return "", nil
+}
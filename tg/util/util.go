@@ -18,13 +18,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/lexurco/gobuffet/util"
+	"time"
 )
 
 type Conf struct {
@@ -47,35 +47,295 @@ func ReadToken(file string) (token string, err error) {
 	return strings.TrimSpace(string(buf)), nil
 }
 
-func Send(conf *Conf, msg string) (err error) {
-	if conf == nil {
-		return nil
+// NewConfFromEnv is like NewConf, but the token is taken from the
+// environment variable env, so it needn't be written to a file.
+func NewConfFromEnv(env string, chat int) (conf *Conf, err error) {
+	token := strings.TrimSpace(os.Getenv(env))
+	if token == "" {
+		return nil, errors.New("no token in " + env)
 	}
+	return NewConf(token, chat), nil
+}
 
-	url := "https://api.telegram.org/bot" + url.QueryEscape(conf.token) +
-		"/sendMessage?chat_id=" + url.QueryEscape(conf.chat)
+// LoadConf makes a Conf with the token read from file or, if file is empty,
+// taken from the environment variable env.  If both are empty, conf is nil.
+func LoadConf(file, env string, chat int) (conf *Conf, err error) {
+	switch {
+	case file != "" && env != "":
+		return nil, errors.New("token file and variable are mutually exclusive")
+	case file != "":
+		token, err := ReadToken(file)
+		if err != nil {
+			return nil, errors.New("error reading " + file + ": " + err.Error())
+		}
+		return NewConf(token, chat), nil
+	case env != "":
+		return NewConfFromEnv(env, chat)
+	}
+	return nil, nil
+}
+
+// redact removes the token from err, which may contain the request URL.
+func (conf *Conf) redact(err error) error {
+	msg := err.Error()
+	for _, t := range []string{url.QueryEscape(conf.token), conf.token} {
+		if t != "" {
+			msg = strings.ReplaceAll(msg, t, "<token>")
+		}
+	}
+	return errors.New(msg)
+}
+
+// apiURL is where the bot API is.
+var apiURL = "https://api.telegram.org"
+
+// call calls the bot API method with the parameters in params, returning
+// its result.  Unsuccessful calls are errors with Telegram's description.
+func (conf *Conf) call(method string, params map[string]string) (result json.RawMessage,
+	err error) {
+
+	u := apiURL + "/bot" + url.QueryEscape(conf.token) + "/" + method
 
-	data := map[string]string{"text": msg}
 	var buf bytes.Buffer
-	if err = json.NewEncoder(&buf).Encode(data); err != nil {
-		util.Die(err)
+	if err = json.NewEncoder(&buf).Encode(params); err != nil {
+		return nil, err
 	}
 
-	resp, err := http.Post(url, "application/json", &buf)
+	// Errors from net/http quote the URL, which has the token in it.
+	req, err := http.NewRequest(http.MethodPost, u, &buf)
 	if err != nil {
-		return err
+		return nil, conf.redact(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, conf.redact(err)
+	}
+	defer resp.Body.Close()
 
 	var body struct {
-		OK bool
+		OK          bool
+		Description string
+		Result      json.RawMessage
 	}
 	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		return err
+		return nil, conf.redact(err)
 	}
 
 	if !body.OK {
-		return errors.New("telegram API error")
+		if body.Description == "" {
+			body.Description = resp.Status
+		}
+		return nil, errors.New("telegram API error: " + body.Description)
+	}
+
+	return body.Result, nil
+}
+
+// GetMe returns the user name of the bot, checking the token.
+func GetMe(conf *Conf) (name string, err error) {
+	result, err := conf.call("getMe", map[string]string{})
+	if err != nil {
+		return "", err
+	}
+	var me struct {
+		Username string
+	}
+	if err = json.Unmarshal(result, &me); err != nil {
+		return "", err
+	}
+	return me.Username, nil
+}
+
+func Send(conf *Conf, msg string) (err error) {
+	return SendButtons(conf, msg, nil)
+}
+
+// Button is a button under a message.  Pressing it sends Data back to the
+// bot as a callback query.
+type Button struct {
+	Text string `json:"text"`
+	Data string `json:"callback_data"`
+}
+
+// SendButtons is like Send, but puts buttons, if any, in a row under msg.
+func SendButtons(conf *Conf, msg string, buttons []Button) (err error) {
+	if conf == nil {
+		return nil
+	}
+	params := map[string]string{
+		"chat_id": conf.chat,
+		"text":    msg,
+	}
+	if len(buttons) > 0 {
+		markup, err := json.Marshal(struct {
+			Keyboard [][]Button `json:"inline_keyboard"`
+		}{[][]Button{buttons}})
+		if err != nil {
+			return err
+		}
+		params["reply_markup"] = string(markup)
 	}
+	_, err = conf.call("sendMessage", params)
+	return err
+}
 
-	return nil
+// Callback is the press of a button sent by SendButtons.
+type Callback struct {
+	ID        string
+	Data      string // of the button
+	From      string // name of who pressed it
+	Chat      string
+	MessageID int
+	Text      string // of the message
 }
+
+// ParseUpdate reads an update sent to a webhook.  cb is nil if the update
+// isn't a callback query.
+func ParseUpdate(r io.Reader) (cb *Callback, err error) {
+	var u struct {
+		CallbackQuery *struct {
+			ID   string
+			Data string
+			From struct {
+				Username  string
+				FirstName string `json:"first_name"`
+			}
+			Message *struct {
+				MessageID int `json:"message_id"`
+				Text      string
+				Chat      struct {
+					ID int64
+				}
+			}
+		} `json:"callback_query"`
+	}
+	if err = json.NewDecoder(r).Decode(&u); err != nil {
+		return nil, err
+	}
+	q := u.CallbackQuery
+	if q == nil || q.Message == nil {
+		return nil, nil
+	}
+	cb = &Callback{
+		ID:        q.ID,
+		Data:      q.Data,
+		From:      q.From.FirstName,
+		Chat:      strconv.FormatInt(q.Message.Chat.ID, 10),
+		MessageID: q.Message.MessageID,
+		Text:      q.Message.Text,
+	}
+	if q.From.Username != "" {
+		cb.From = "@" + q.From.Username
+	}
+	return cb, nil
+}
+
+// InChat reports whether chat is the chat of conf.
+func (conf *Conf) InChat(chat string) bool {
+	return chat == conf.chat
+}
+
+// Message is a text message to the bot.
+type Message struct {
+	Chat string
+	From string // name of the sender
+	Text string
+}
+
+// GetUpdates waits up to timeout for the messages to the bot with update
+// IDs from offset on.  It returns them with the offset of the updates
+// after them, which confirms them when passed to GetUpdates or Confirm,
+// so that Telegram doesn't send them again.
+func GetUpdates(conf *Conf, offset int, timeout time.Duration) (msgs []Message,
+	next int, err error) {
+
+	result, err := conf.call("getUpdates", map[string]string{
+		"offset":          strconv.Itoa(offset),
+		"timeout":         strconv.Itoa(int(timeout.Seconds())),
+		"allowed_updates": `["message"]`,
+	})
+	if err != nil {
+		return nil, offset, err
+	}
+
+	var updates []struct {
+		UpdateID int `json:"update_id"`
+		Message  *struct {
+			Text string
+			From struct {
+				Username  string
+				FirstName string `json:"first_name"`
+			}
+			Chat struct {
+				ID int64
+			}
+		}
+	}
+	if err = json.Unmarshal(result, &updates); err != nil {
+		return nil, offset, err
+	}
+	next = offset
+	for _, u := range updates {
+		next = max(next, u.UpdateID+1)
+		if u.Message == nil || u.Message.Text == "" {
+			continue
+		}
+		m := Message{
+			Chat: strconv.FormatInt(u.Message.Chat.ID, 10),
+			From: u.Message.From.FirstName,
+			Text: u.Message.Text,
+		}
+		if u.Message.From.Username != "" {
+			m.From = "@" + u.Message.From.Username
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, next, nil
+}
+
+// Confirm confirms the updates before offset, as returned by GetUpdates,
+// without waiting for more.
+func Confirm(conf *Conf, offset int) (err error) {
+	_, err = conf.call("getUpdates", map[string]string{
+		"offset":  strconv.Itoa(offset),
+		"limit":   "1",
+		"timeout": "0",
+	})
+	return err
+}
+
+// Answer answers cb, showing text, if any, to whoever pressed the button.
+func Answer(conf *Conf, cb *Callback, text string) (err error) {
+	_, err = conf.call("answerCallbackQuery", map[string]string{
+		"callback_query_id": cb.ID,
+		"text":              text,
+	})
+	return err
+}
+
+// Edit replaces the text of the message of cb, removing its buttons.
+func Edit(conf *Conf, cb *Callback, text string) (err error) {
+	_, err = conf.call("editMessageText", map[string]string{
+		"chat_id":    cb.Chat,
+		"message_id": strconv.Itoa(cb.MessageID),
+		"text":       text,
+	})
+	return err
+}
+
+// SetWebhook has Telegram send the callback queries of the bot to hook,
+// with secret in the X-Telegram-Bot-Api-Secret-Token header.  An empty hook
+// removes the webhook.
+func SetWebhook(conf *Conf, hook, secret string) (err error) {
+	_, err = conf.call("setWebhook", map[string]string{
+		"url":             hook,
+		"secret_token":    secret,
+		"allowed_updates": `["callback_query"]`,
+	})
+	return err
+}
+
+// SecretHeader is the header of webhook requests with the secret given to
+// SetWebhook.
+const SecretHeader = "X-Telegram-Bot-Api-Secret-Token"
@@ -0,0 +1,71 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package util
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTokenNotInErrors(t *testing.T) {
+	const token = "123456:secret/token"
+	conf := NewConf(token, 1)
+
+	// A port nothing listens on, for the error of a failed connection.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + l.Addr().String()
+	l.Close()
+
+	for _, c := range []struct {
+		name    string
+		handler http.HandlerFunc // of the API, if it is up
+	}{
+		{"connection refused", nil},
+		{"not JSON", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html>" + r.URL.Path))
+		}},
+		{"API error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ok":false}`))
+		}},
+		{"redirect", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, closed+r.URL.Path, http.StatusFound)
+		}},
+	} {
+		apiURL = closed
+		if c.handler != nil {
+			ts := httptest.NewServer(c.handler)
+			defer ts.Close()
+			apiURL = ts.URL
+		}
+		err := Send(conf, "hello")
+		if err == nil {
+			t.Errorf("%v: no error", c.name)
+			continue
+		}
+		for _, s := range []string{token, url.QueryEscape(token), "secret"} {
+			if strings.Contains(err.Error(), s) {
+				t.Errorf("%v: token in error %q", c.name, err)
+			}
+		}
+	}
+}
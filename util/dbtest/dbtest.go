@@ -0,0 +1,259 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+// Package dbtest provides a fake database for tests, which records the
+// statements run on it and answers queries with canned rows.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Stmt is a statement run on a DB, with its arguments.
+type Stmt struct {
+	SQL  string
+	Args []any
+}
+
+// DB is a fake database implementing util.DB.  Rows, if set, gives the
+// rows of each statement run, or the rows affected by it if it is run
+// with Exec; there are none otherwise.
+type DB struct {
+	Rows func(sql string, args []any) (rows [][]any, err error)
+	Down bool // if Ping fails
+
+	mu    sync.Mutex
+	stmts []Stmt
+}
+
+// Stmts returns the statements run on db so far.
+func (db *DB) Stmts() (stmts []Stmt) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append(stmts, db.stmts...)
+}
+
+// Find returns the first statement run on db containing s.
+func (db *DB) Find(s string) (stmt Stmt, ok bool) {
+	for _, stmt = range db.Stmts() {
+		if strings.Contains(stmt.SQL, s) {
+			return stmt, true
+		}
+	}
+	return Stmt{}, false
+}
+
+// Reset forgets the statements run on db so far.
+func (db *DB) Reset() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.stmts = nil
+}
+
+var paramRE = regexp.MustCompile(`\$([0-9]+)`)
+
+// run records the statement and returns its rows, failing as the server
+// would if the arguments don't match the parameters.
+func (db *DB) run(sql string, args []any) (rows [][]any, err error) {
+	db.mu.Lock()
+	db.stmts = append(db.stmts, Stmt{sql, args})
+	db.mu.Unlock()
+
+	params := 0
+	for _, m := range paramRE.FindAllStringSubmatch(sql, -1) {
+		n, _ := strconv.Atoi(m[1])
+		params = max(params, n)
+	}
+	if params != len(args) {
+		return nil, fmt.Errorf("dbtest: %v parameters but %v arguments in %q",
+			params, len(args), sql)
+	}
+	if db.Rows == nil {
+		return nil, nil
+	}
+	return db.Rows(sql, args)
+}
+
+func (db *DB) Begin(ctx context.Context) (tx pgx.Tx, err error) {
+	return &fakeTx{db}, nil
+}
+
+func (db *DB) Exec(ctx context.Context, sql string, args ...any) (tag pgconn.CommandTag,
+	err error) {
+
+	rows, err := db.run(sql, args)
+	if err != nil {
+		return tag, err
+	}
+	return pgconn.NewCommandTag(fmt.Sprintf("EXEC %v", len(rows))), nil
+}
+
+func (db *DB) Query(ctx context.Context, sql string, args ...any) (r pgx.Rows, err error) {
+	rows, err := db.run(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows, i: -1}, nil
+}
+
+func (db *DB) QueryRow(ctx context.Context, sql string, args ...any) (r pgx.Row) {
+	rows, err := db.run(sql, args)
+	return &fakeRow{rows: rows, err: err}
+}
+
+func (db *DB) Ping(ctx context.Context) (err error) {
+	if db.Down {
+		return errors.New("database down")
+	}
+	return nil
+}
+
+func (db *DB) Close(ctx context.Context) (err error) {
+	return nil
+}
+
+// fakeTx is a transaction of a DB, which runs its statements right away.
+type fakeTx struct {
+	*DB
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) (err error) {
+	return nil
+}
+
+func (tx *fakeTx) Rollback(ctx context.Context) (err error) {
+	return nil
+}
+
+func (tx *fakeTx) CopyFrom(ctx context.Context, table pgx.Identifier, cols []string,
+	src pgx.CopyFromSource) (n int64, err error) {
+
+	return 0, errors.New("dbtest: CopyFrom not supported")
+}
+
+func (tx *fakeTx) SendBatch(ctx context.Context, b *pgx.Batch) (br pgx.BatchResults) {
+	return nil
+}
+
+func (tx *fakeTx) LargeObjects() (lo pgx.LargeObjects) {
+	return lo
+}
+
+func (tx *fakeTx) Prepare(ctx context.Context, name, sql string) (
+	sd *pgconn.StatementDescription, err error) {
+
+	return nil, errors.New("dbtest: Prepare not supported")
+}
+
+func (tx *fakeTx) Conn() (conn *pgx.Conn) {
+	return nil
+}
+
+type fakeRows struct {
+	rows [][]any
+	i    int
+}
+
+func (r *fakeRows) Close()                                       {}
+func (r *fakeRows) Err() (err error)                             { return nil }
+func (r *fakeRows) CommandTag() (tag pgconn.CommandTag)          { return tag }
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *fakeRows) RawValues() (v [][]byte)                      { return nil }
+func (r *fakeRows) Conn() (conn *pgx.Conn)                       { return nil }
+
+func (r *fakeRows) Next() (ok bool) {
+	r.i++
+	return r.i < len(r.rows)
+}
+
+func (r *fakeRows) Values() (v []any, err error) {
+	return r.rows[r.i], nil
+}
+
+func (r *fakeRows) Scan(dest ...any) (err error) {
+	return scan(r.rows[r.i], dest)
+}
+
+type fakeRow struct {
+	rows [][]any
+	err  error
+}
+
+func (r *fakeRow) Scan(dest ...any) (err error) {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.rows) == 0 {
+		return pgx.ErrNoRows
+	}
+	return scan(r.rows[0], dest)
+}
+
+// scan stores the values of row in dest, as pgx would, more or less.
+func scan(row []any, dest []any) (err error) {
+	if len(row) != len(dest) {
+		return fmt.Errorf("dbtest: %v values scanned into %v destinations",
+			len(row), len(dest))
+	}
+	for i, v := range row {
+		if err = assign(dest[i], v); err != nil {
+			return fmt.Errorf("dbtest: column %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func assign(dest any, v any) (err error) {
+	if s, ok := dest.(interface{ Scan(src any) error }); ok {
+		return s.Scan(v)
+	}
+	d := reflect.ValueOf(dest)
+	if d.Kind() != reflect.Pointer || d.IsNil() {
+		return errors.New("destination not a pointer")
+	}
+	d = d.Elem()
+	if v == nil {
+		d.SetZero()
+		return nil
+	}
+	s := reflect.ValueOf(v)
+	for d.Kind() == reflect.Pointer && !s.Type().AssignableTo(d.Type()) {
+		p := reflect.New(d.Type().Elem())
+		d.Set(p)
+		d = p.Elem()
+	}
+	switch {
+	case s.Type().AssignableTo(d.Type()):
+		d.Set(s)
+	case s.Kind() == reflect.String && d.Type() == reflect.TypeOf([]byte(nil)):
+		d.SetBytes([]byte(s.String()))
+	case s.Kind() != reflect.String && d.Kind() == reflect.String:
+		return fmt.Errorf("can't scan %T into %v", v, d.Type())
+	case s.Type().ConvertibleTo(d.Type()):
+		d.Set(s.Convert(d.Type()))
+	default:
+		return fmt.Errorf("can't scan %T into %v", v, d.Type())
+	}
+	return nil
+}
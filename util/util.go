@@ -15,18 +15,24 @@
 package util
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 func Die(a ...any) {
@@ -34,11 +40,148 @@ func Die(a ...any) {
 	os.Exit(1)
 }
 
+// EnvPrefix starts the names of the environment variables that set flags,
+// e.g. GOBUFFET_DB for -db.
+const EnvPrefix = "GOBUFFET_"
+
+// LoadEnv sets the flags in fs that aren't set explicitly from the
+// environment.
+func LoadEnv(fs *flag.FlagSet) (err error) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	fs.VisitAll(func(f *flag.Flag) {
+		env := EnvPrefix + strings.ToUpper(f.Name)
+		if v, ok := os.LookupEnv(env); ok && !set[f.Name] && err == nil {
+			if err = fs.Set(f.Name, v); err != nil {
+				err = fmt.Errorf("%v: %v", env, err)
+			}
+		}
+	})
+	return err
+}
+
+// LoadConfig sets the flags in fs from the JSON object in file, whose keys
+// are flag names.  Flags already set explicitly are left alone.  Arrays set
+// a flag once per element.
+func LoadConfig(fs *flag.FlagSet, file string) (err error) {
+	return loadConfig(fs, file, false)
+}
+
+// LoadSharedConfig sets the flags in fs from file as LoadConfig does, but
+// ignores the settings fs lacks, so that the other subcommands may read
+// the config file of serve.
+func LoadSharedConfig(fs *flag.FlagSet, file string) (err error) {
+	return loadConfig(fs, file, true)
+}
+
+func loadConfig(fs *flag.FlagSet, file string, shared bool) (err error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var conf map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&conf); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for name, v := range conf {
+		if fs.Lookup(name) == nil {
+			if shared {
+				continue
+			}
+			return errors.New("unknown setting " + name)
+		}
+		if set[name] {
+			continue
+		}
+		vals, ok := v.([]any)
+		if !ok {
+			vals = []any{v}
+		}
+		for _, v := range vals {
+			if err = fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PrintConfig writes the values of the flags in fs as a JSON object, as read
+// by LoadConfig.  Flags named in skip are left out.
+func PrintConfig(w io.Writer, fs *flag.FlagSet, skip ...string) (err error) {
+	conf := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !slices.Contains(skip, f.Name) {
+			conf[f.Name] = f.Value.String()
+		}
+	})
+
+	b, err := json.MarshalIndent(conf, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// ImgDir is the image directory, set by -imgdir of item and serve.
+var ImgDir = "img"
+
+// ImgPath returns the path of base in the image directory.
 func ImgPath(base string) (path string) {
-	return "img/" + base
+	return ImgDir + "/" + base
+}
+
+// imgLock is the open lock file of the image directory.  It is kept so
+// that the file, and with it the lock, isn't closed.
+var imgLock *os.File
+
+// LockImgs locks the image directory for the rest of the process, so that
+// processes writing to it don't race on its files.  A shared lock lets in
+// other shared locks, but no exclusive one.  It fails right away if the
+// directory is locked otherwise.
+func LockImgs(shared bool) (err error) {
+	if err = os.MkdirAll(ImgPath(""), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ImgPath(".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return errors.New(ImgPath("") + " is in use by another process")
+		}
+		return err
+	}
+	imgLock = f
+	return nil
+}
+
+// DB is what the item, order and pw packages need of a database
+// connection.  *pgx.Conn implements it, and so may a stub in tests.
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 }
 
-func DBTest(conn *pgx.Conn) (err error) {
+func DBTest(conn interface{ Ping(context.Context) error }) (err error) {
 	if conn == nil {
 		return errors.New("conn is nil")
 	}
@@ -51,6 +194,9 @@ func DBTest(conn *pgx.Conn) (err error) {
 	return err
 }
 
+// DBConnect connects to the database given by the connection string s.
+// Anything s leaves out comes from the libpq environment variables, such
+// as PGDATABASE, PGHOST and PGUSER.
 func DBConnect(s string) (conn *pgx.Conn, err error) {
 	if conn, err = pgx.Connect(context.Background(), s); err != nil {
 		return nil, err
@@ -0,0 +1,47 @@
+// COPYRIGHT (c) 2025 Eneik
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package util
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSharedConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gobuffet.json")
+	conf := `{"db": "dbname=shop", "imgdir": "pics", "listen": ":80"}`
+	if err := os.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("item", flag.ContinueOnError)
+	db := fs.String("db", "", "")
+	imgDir := fs.String("imgdir", "img", "")
+	if err := fs.Parse([]string{"-imgdir", "img2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfig(fs, file); err == nil {
+		t.Error("LoadConfig took the unknown setting listen")
+	}
+	if err := LoadSharedConfig(fs, file); err != nil {
+		t.Fatal(err)
+	}
+	// imgdir was given on the command line.
+	if *db != "dbname=shop" || *imgDir != "img2" {
+		t.Errorf("db %q, imgdir %q; want dbname=shop, img2", *db, *imgDir)
+	}
+}